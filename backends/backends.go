@@ -0,0 +1,14 @@
+// Package backends links every PoW backend into a binary. Importing it for its
+// side effects registers all boards with pidiver.RegisterDiver:
+//
+//	import _ "github.com/shufps/pidiver/backends"
+//
+// Backends which need cgo and the WiringOP/wiringPi submodules are only
+// included when building with the tags "orange_pi_pc" or "wiringpi".
+package backends
+
+import (
+	_ "github.com/shufps/pidiver/pidiver"
+	_ "github.com/shufps/pidiver/raspberry"
+	_ "github.com/shufps/pidiver/spidev"
+)
@@ -0,0 +1,8 @@
+//go:build orange_pi_pc
+// +build orange_pi_pc
+
+package backends
+
+import (
+	_ "github.com/shufps/pidiver/orange_pi_pc"
+)
@@ -0,0 +1,8 @@
+//go:build wiringpi
+// +build wiringpi
+
+package backends
+
+import (
+	_ "github.com/shufps/pidiver/raspberry_wiringPi"
+)
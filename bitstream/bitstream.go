@@ -0,0 +1,241 @@
+// Package bitstream reads FPGA cores (raw binary files, .rbf) and checks them
+// before they are uploaded: the file is read completely, its size is checked
+// against the target FPGA and a SHA-256 is calculated. Metadata (core version,
+// parallel level, ...) is kept in a sidecar file next to the core (<core>.json).
+package bitstream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// FPGA of the PiDiver and USBDiver
+	DEFAULT_DEVICE = "EP4CE22"
+
+	// nothing bigger fits into the flash of the USBDiver
+	MAX_SIZE = 1024 * 1024
+
+	META_EXTENSION = ".json"
+
+	// first byte after the 0xff padding of the header
+	SYNC_BYTE  = 0x6a
+	SYNC_RANGE = 256
+)
+
+var (
+	ErrEmpty    = errors.New("core file is empty")
+	ErrTooBig   = errors.New("core file is too big")
+	ErrNoSync   = errors.New("no sync pattern - not a raw binary file (.rbf)")
+	ErrChecksum = errors.New("sha256 of core doesn't match its metadata")
+)
+
+// size of an uncompressed raw binary file in bytes
+var devices = map[string]int{
+	"EP4CE6":  368011,
+	"EP4CE10": 368011,
+	"EP4CE15": 563709,
+	"EP4CE22": 718569,
+	"10CL006": 368011,
+	"10CL010": 368011,
+	"10CL016": 563709,
+	"10CL025": 718569,
+}
+
+// names of the known FPGAs
+func Devices() []string {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// size of an uncompressed core for the FPGA
+func DeviceSize(device string) (int, error) {
+	size, ok := devices[strings.ToUpper(device)]
+	if !ok {
+		return 0, fmt.Errorf("unknown fpga %s (one of %q)", device, Devices())
+	}
+	return size, nil
+}
+
+type Meta struct {
+	Version  string    `json:"version,omitempty"`
+	Parallel int       `json:"parallel,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+type Bitstream struct {
+	Filename string
+	Data     []byte
+	SHA256   [sha256.Size]byte
+	Meta     Meta
+	HasMeta  bool // metadata was loaded from the sidecar file
+}
+
+// version in file names like pidiver1.1.rbf
+var versionPattern = regexp.MustCompile(`(\d+\.\d+)\.rbf$`)
+
+// read the whole core and its metadata. If there is no sidecar file, the
+// version is taken from the file name.
+func Read(filename string) (*Bitstream, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stats.Size()
+	if size == 0 {
+		return nil, ErrEmpty
+	}
+	if size > MAX_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrTooBig, size, MAX_SIZE)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("couldn't read %s: %v", filename, err)
+	}
+
+	b := &Bitstream{Filename: filename, Data: data, SHA256: sha256.Sum256(data)}
+
+	metaData, err := ioutil.ReadFile(MetaFilename(filename))
+	if err == nil {
+		if err := json.Unmarshal(metaData, &b.Meta); err != nil {
+			return nil, fmt.Errorf("couldn't parse %s: %v", MetaFilename(filename), err)
+		}
+		b.HasMeta = true
+		if b.Meta.SHA256 != "" && !strings.EqualFold(b.Meta.SHA256, b.Checksum()) {
+			return nil, ErrChecksum
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if b.Meta.Version == "" {
+		if m := versionPattern.FindStringSubmatch(filepath.Base(filename)); m != nil {
+			b.Meta.Version = m[1]
+		}
+	}
+	return b, nil
+}
+
+// read and check the core for the FPGA (empty: device of the metadata or DEFAULT_DEVICE)
+func Load(filename string, device string) (*Bitstream, error) {
+	b, err := Read(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Check(device); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// sidecar file with the metadata
+func MetaFilename(filename string) string {
+	return filename + META_EXTENSION
+}
+
+func (b *Bitstream) Size() int {
+	return len(b.Data)
+}
+
+func (b *Bitstream) Checksum() string {
+	return hex.EncodeToString(b.SHA256[:])
+}
+
+// target FPGA - device, metadata or default
+func (b *Bitstream) Device(device string) string {
+	if device != "" {
+		return strings.ToUpper(device)
+	}
+	if b.Meta.Device != "" {
+		return strings.ToUpper(b.Meta.Device)
+	}
+	return DEFAULT_DEVICE
+}
+
+// the header starts with 0xff padding followed by the sync byte
+func (b *Bitstream) HasSync() bool {
+	for i := 0; i < len(b.Data) && i < SYNC_RANGE; i++ {
+		if b.Data[i] == 0xff {
+			continue
+		}
+		return b.Data[i] == SYNC_BYTE
+	}
+	return false
+}
+
+// smaller than an uncompressed core for the FPGA
+func (b *Bitstream) Compressed(device string) bool {
+	size, err := DeviceSize(b.Device(device))
+	return err == nil && len(b.Data) < size
+}
+
+// check size and header for the FPGA
+func (b *Bitstream) Check(device string) error {
+	size, err := DeviceSize(b.Device(device))
+	if err != nil {
+		return err
+	}
+	if len(b.Data) > size {
+		return fmt.Errorf("%w for %s: %d bytes (max %d)", ErrTooBig, b.Device(device), len(b.Data), size)
+	}
+	if !b.HasSync() {
+		return ErrNoSync
+	}
+	return nil
+}
+
+// data padded with 0xff to a multiple of n bytes
+func (b *Bitstream) Padded(n int) []byte {
+	size := len(b.Data)
+	if size%n != 0 {
+		size += n - size%n
+	}
+	data := make([]byte, size)
+	copy(data, b.Data)
+	for i := len(b.Data); i < size; i++ {
+		data[i] = 0xff
+	}
+	return data
+}
+
+// write the metadata with the current SHA-256 to the sidecar file
+func (b *Bitstream) WriteMeta() error {
+	b.Meta.SHA256 = b.Checksum()
+	if b.Meta.Created.IsZero() {
+		b.Meta.Created = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(&b.Meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(MetaFilename(b.Filename), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	b.HasMeta = true
+	return nil
+}
@@ -0,0 +1,116 @@
+package bitstream
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 0xff padding, sync byte and random configuration data
+func testCore(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := 0; i < 32; i++ {
+		data[i] = 0xff
+	}
+	data[32] = SYNC_BYTE
+	return data
+}
+
+func writeFile(t *testing.T, filename string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pidiver1.1.rbf")
+	data := testCore(100000)
+	writeFile(t, filename, data)
+
+	// no sidecar - version of the file name
+	b, err := Load(filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Data, data) || b.HasMeta || b.Meta.Version != "1.1" || b.Device("") != DEFAULT_DEVICE {
+		t.Errorf("core %s: %d bytes, %+v", b.Filename, b.Size(), b.Meta)
+	}
+	if !b.Compressed("") {
+		t.Error("core is compressed")
+	}
+
+	b.Meta = Meta{Version: "2.0", Parallel: 5, Device: "ep4ce6"}
+	if err := b.WriteMeta(); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := Load(filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b2.HasMeta || b2.Meta.Version != "2.0" || b2.Meta.Parallel != 5 || b2.Checksum() != b.Checksum() || b2.Device("") != "EP4CE6" {
+		t.Errorf("core with sidecar: %+v", b2.Meta)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tooBig, _ := DeviceSize("EP4CE6")
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		meta   string // sidecar (empty: none)
+		device string
+		err    error
+	}{
+		{"empty", nil, "", "", ErrEmpty},
+		{"too big", testCore(MAX_SIZE + 1), "", "", ErrTooBig},
+		{"too big for fpga", testCore(tooBig + 1), "", "EP4CE6", ErrTooBig},
+		{"bad header", bytes.Repeat([]byte{0x42}, 1000), "", "", ErrNoSync},
+		{"truncated", bytes.Repeat([]byte{0xff}, 20), "", "", ErrNoSync},
+		{"checksum", testCore(1000), `{"sha256": "` + strings.Repeat("0", 64) + `"}`, "", ErrChecksum},
+	} {
+		filename := filepath.Join(dir, strings.Replace(test.name, " ", "_", -1)+".rbf")
+		writeFile(t, filename, test.data)
+		if test.meta != "" {
+			writeFile(t, MetaFilename(filename), []byte(test.meta))
+		}
+		if _, err := Load(filename, test.device); !errors.Is(err, test.err) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestLoadBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.rbf"), ""); !os.IsNotExist(err) {
+		t.Errorf("missing core: %v", err)
+	}
+
+	filename := filepath.Join(dir, "core.rbf")
+	writeFile(t, filename, testCore(1000))
+	writeFile(t, MetaFilename(filename), []byte(`{"version": `))
+	if _, err := Load(filename, ""); err == nil {
+		t.Error("core with broken sidecar loaded")
+	}
+	os.Remove(MetaFilename(filename))
+	if _, err := Load(filename, "EP9"); err == nil {
+		t.Error("core for unknown fpga loaded")
+	}
+}
+
+func TestPadded(t *testing.T) {
+	b := &Bitstream{Data: []byte{1, 2, 3}}
+	if data := b.Padded(4); !bytes.Equal(data, []byte{1, 2, 3, 0xff}) {
+		t.Errorf("padded: %v", data)
+	}
+	if data := b.Padded(3); !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("padded: %v", data)
+	}
+}
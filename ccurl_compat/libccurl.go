@@ -2,12 +2,17 @@ package main
 
 import (
 	"C"
+	"context"
+	"errors"
+	"sync"
 
-	"github.com/iotaledger/iota.go/trinary"
 	"github.com/iotaledger/iota.go/consts"
+	"github.com/iotaledger/iota.go/trinary"
+	_ "github.com/shufps/pidiver/backends"
 	"github.com/shufps/pidiver/pidiver"
 )
 
+var diverType = "usbdiver"
 var device = "/dev/ttyACM0"
 var configFile = "./pidiver1.1.rbf"
 var forceFlash = false
@@ -20,24 +25,42 @@ var config = pidiver.PiDiverConfig{
 	ForceConfigure: forceConfigure}
 
 var initialized = false
-var usb pidiver.USBDiver
+var diver pidiver.Diver
+
+// cancels the running PoW (set while ccurl_pow is working)
+var cancelLock sync.Mutex
+var cancelPow context.CancelFunc
 
 //export ccurl_pow
 func ccurl_pow(trytes *C.char, mwm uint) *C.char {
 	//    print(C.GoString(trytes))
-    var err error
+	var err error
 	if !initialized {
-		usb = pidiver.USBDiver{Config: &config}
-		err = usb.InitUSBDiver()
+		diver, err = pidiver.OpenDiver(diverType, &config)
 		if err != nil {
-			println("error initializing usbdiver!")
+			println("error initializing " + diverType + ": " + err.Error())
 			return nil
 		}
 		initialized = true
 	}
 	goTrytes := C.GoString(trytes)
 
-	nonce, err := usb.PowUSBDiver(trinary.Trytes(goTrytes), int(mwm))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelLock.Lock()
+	cancelPow = cancel
+	cancelLock.Unlock()
+
+	nonce, err := diver.PoWContext(ctx, trinary.Trytes(goTrytes), int(mwm))
+
+	cancelLock.Lock()
+	cancelPow = nil
+	cancelLock.Unlock()
+	cancel()
+
+	if errors.Is(err, pidiver.ErrCancelled) {
+		println("pow interrupted!")
+		return nil
+	}
 	if err != nil {
 		println("error pow!")
 		return nil
@@ -51,10 +74,19 @@ func ccurl_pow(trytes *C.char, mwm uint) *C.char {
 
 //export ccurl_pow_finalize
 func ccurl_pow_finalize() {
+	if initialized {
+		diver.Close()
+		initialized = false
+	}
 }
 
 //export ccurl_pow_interrupt
 func ccurl_pow_interrupt() {
+	cancelLock.Lock()
+	if cancelPow != nil {
+		cancelPow()
+	}
+	cancelLock.Unlock()
 }
 
 func main() {}
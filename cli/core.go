@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/shufps/pidiver/bitstream"
+
+	flag "github.com/spf13/pflag"
+)
+
+// print everything about the cores without touching a device
+func coreInspect(args []string) error {
+	flags := flag.NewFlagSet("core inspect", flag.ContinueOnError)
+	device := flags.StringP("fpga", "d", "", fmt.Sprintf("target fpga - one of %q (default: from metadata or %s)", bitstream.Devices(), bitstream.DEFAULT_DEVICE))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no core file")
+	}
+
+	failed := false
+	for i, filename := range flags.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := inspect(filename, *device); err != nil {
+			fmt.Printf("Error:      %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("check failed")
+	}
+	return nil
+}
+
+func inspect(filename string, device string) error {
+	fmt.Printf("File:       %s\n", filename)
+	core, err := bitstream.Read(filename)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Size:       %d bytes\n", core.Size())
+	fmt.Printf("SHA-256:    %s\n", core.Checksum())
+	fmt.Printf("FPGA:       %s\n", core.Device(device))
+	if size, err := bitstream.DeviceSize(core.Device(device)); err == nil {
+		fmt.Printf("Max size:   %d bytes\n", size)
+		fmt.Printf("Compressed: %v\n", core.Compressed(device))
+	}
+	fmt.Printf("Sync:       %v\n", core.HasSync())
+
+	metaSource := "file name"
+	if core.HasMeta {
+		metaSource = bitstream.MetaFilename(filename)
+	}
+	fmt.Printf("Metadata:   %s\n", metaSource)
+	fmt.Printf("Version:    %s\n", valueOrUnknown(core.Meta.Version))
+	if core.Meta.Parallel > 0 {
+		fmt.Printf("Parallel:   %d\n", core.Meta.Parallel)
+	} else {
+		fmt.Printf("Parallel:   unknown\n")
+	}
+	if !core.Meta.Created.IsZero() {
+		fmt.Printf("Created:    %s\n", core.Meta.Created)
+	}
+	if core.Meta.Comment != "" {
+		fmt.Printf("Comment:    %s\n", core.Meta.Comment)
+	}
+
+	if err := core.Check(device); err != nil {
+		return err
+	}
+	fmt.Printf("Check:      ok\n")
+	return nil
+}
+
+func valueOrUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// write metadata of a core to its sidecar file
+func coreAttach(args []string) error {
+	flags := flag.NewFlagSet("core attach", flag.ContinueOnError)
+	device := flags.StringP("fpga", "d", "", "target fpga")
+	version := flags.String("version", "", "core version (e.g. 1.1)")
+	parallel := flags.Int("parallel", 0, "parallel level of the core")
+	comment := flags.String("comment", "", "comment")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one core file needed")
+	}
+
+	filename := flags.Arg(0)
+	// metadata with a wrong checksum is replaced
+	core, err := bitstream.Read(filename)
+	if errors.Is(err, bitstream.ErrChecksum) {
+		fmt.Fprintf(os.Stderr, "warning: %v - replacing metadata\n", err)
+		os.Remove(bitstream.MetaFilename(filename))
+		core, err = bitstream.Read(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *device != "" {
+		core.Meta.Device = core.Device(*device)
+	}
+	if *version != "" {
+		core.Meta.Version = *version
+	}
+	if *parallel > 0 {
+		core.Meta.Parallel = *parallel
+	}
+	if *comment != "" {
+		core.Meta.Comment = *comment
+	}
+	if err := core.Check(""); err != nil {
+		return err
+	}
+	if err := core.WriteMeta(); err != nil {
+		return err
+	}
+	return inspect(filename, "")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/shufps/pidiver/pidiver"
+
+	flag "github.com/spf13/pflag"
+)
+
+const DEFAULT_USB_DEVICE = "/dev/ttyACM0"
+
+// opens the USBDiver without configuring the fpga
+func openFlash(flags *flag.FlagSet, device *string, args []string) (*pidiver.USBDiver, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	usb := &pidiver.USBDiver{Config: &pidiver.PiDiverConfig{Type: "usbdiver", Device: *device}}
+	if err := usb.Open(); err != nil {
+		return nil, err
+	}
+	if !usb.HasFlash() {
+		usb.Close()
+		return nil, fmt.Errorf("USBDiver version %d.%d has no flash", usb.VersionMajor, usb.VersionMinor)
+	}
+	return usb, nil
+}
+
+func flashErase(args []string) error {
+	flags := flag.NewFlagSet("flash erase", flag.ContinueOnError)
+	device := flags.StringP("device", "d", DEFAULT_USB_DEVICE, "usb device")
+	usb, err := openFlash(flags, device, args)
+	if err != nil {
+		return err
+	}
+	defer usb.Close()
+	return usb.FlashErase()
+}
+
+// write a core to flash - the fpga is configured with it if --configure is set
+func flashWrite(args []string) error {
+	flags := flag.NewFlagSet("flash write", flag.ContinueOnError)
+	device := flags.StringP("device", "d", DEFAULT_USB_DEVICE, "usb device")
+	configure := flags.BoolP("configure", "c", false, "configure fpga from flash after writing")
+	usb, err := openFlash(flags, device, args)
+	if err != nil {
+		return err
+	}
+	defer usb.Close()
+	if flags.NArg() != 1 {
+		return errors.New("exactly one core file needed")
+	}
+	if err := usb.FlashWrite(flags.Arg(0)); err != nil {
+		return err
+	}
+	if *configure {
+		return usb.ConfigureFromFlash()
+	}
+	return nil
+}
+
+// write only the pages which differ - an interrupted update continues with the missing pages
+func flashUpdate(args []string) error {
+	flags := flag.NewFlagSet("flash update", flag.ContinueOnError)
+	device := flags.StringP("device", "d", DEFAULT_USB_DEVICE, "usb device")
+	force := flags.BoolP("force", "f", false, "erase and write the whole core")
+	configure := flags.BoolP("configure", "c", false, "configure fpga from flash after updating")
+	usb, err := openFlash(flags, device, args)
+	if err != nil {
+		return err
+	}
+	defer usb.Close()
+	if flags.NArg() != 1 {
+		return errors.New("exactly one core file needed")
+	}
+	if err := usb.FlashUpdate(flags.Arg(0), *force); err != nil {
+		return err
+	}
+	if *configure {
+		return usb.ConfigureFromFlash()
+	}
+	return nil
+}
+
+// verify flash against its meta page (and against a core file if given)
+func flashVerify(args []string) error {
+	flags := flag.NewFlagSet("flash verify", flag.ContinueOnError)
+	device := flags.StringP("device", "d", DEFAULT_USB_DEVICE, "usb device")
+	usb, err := openFlash(flags, device, args)
+	if err != nil {
+		return err
+	}
+	defer usb.Close()
+	if flags.NArg() > 1 {
+		return errors.New("at most one core file")
+	}
+	if err := usb.FlashVerify(flags.Arg(0)); err != nil {
+		return err
+	}
+	fmt.Printf("Verify:     ok\n")
+	return nil
+}
+
+func flashReadMeta(args []string) error {
+	flags := flag.NewFlagSet("flash read-meta", flag.ContinueOnError)
+	device := flags.StringP("device", "d", DEFAULT_USB_DEVICE, "usb device")
+	usb, err := openFlash(flags, device, args)
+	if err != nil {
+		return err
+	}
+	defer usb.Close()
+
+	state, meta, err := usb.FlashState(nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("State:      %s\n", state)
+	if state == pidiver.FlashEmpty {
+		return nil
+	}
+	fmt.Printf("File:       %s\n", meta.FilenameString())
+	fmt.Printf("Size:       %d bytes\n", meta.Filesize)
+	fmt.Printf("Timestamp:  %d\n", meta.Timestamp)
+	fmt.Printf("Meta:       version %d\n", meta.MetaVersion)
+	if meta.HasChecksum() {
+		fmt.Printf("Version:    %s\n", valueOrUnknown(meta.CoreVersionString()))
+		fmt.Printf("SHA-256:    %s\n", meta.SHA256String())
+		fmt.Printf("Checksum:   %08x\n", meta.Checksum)
+	}
+	return nil
+}
+
+// write flash contents to a file
+func flashDump(args []string) error {
+	flags := flag.NewFlagSet("flash dump", flag.ContinueOnError)
+	device := flags.StringP("device", "d", DEFAULT_USB_DEVICE, "usb device")
+	output := flags.StringP("output", "o", "flash.rbf", "output file")
+	size := flags.Int("size", 0, fmt.Sprintf("number of bytes (0: size of the core in flash, max %d)", pidiver.FLASH_SIZE))
+	usb, err := openFlash(flags, device, args)
+	if err != nil {
+		return err
+	}
+	defer usb.Close()
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := usb.FlashDump(f, *size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,73 @@
+// pidiver command line tool
+//
+//	pidiver core inspect [-d fpga] <core.rbf>...
+//	pidiver core attach [-d fpga] [--version v] [--parallel n] [--comment c] <core.rbf>
+//	pidiver flash erase [-d device]
+//	pidiver flash write [-d device] [-c] <core.rbf>
+//	pidiver flash update [-d device] [-f] [-c] <core.rbf>
+//	pidiver flash verify [-d device] [core.rbf]
+//	pidiver flash read-meta [-d device]
+//	pidiver flash dump [-d device] [-o file] [--size n]
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/shufps/pidiver/pidiver"
+)
+
+const APP_VERSION = "0.1"
+
+type command func(args []string) error
+
+var commands = map[string]map[string]command{
+	"core": {
+		"inspect": coreInspect,
+		"attach":  coreAttach,
+	},
+	"flash": {
+		"erase":     flashErase,
+		"write":     flashWrite,
+		"update":    flashUpdate,
+		"verify":    flashVerify,
+		"read-meta": flashReadMeta,
+		"dump":      flashDump,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "pidiver %s\n\nusage:\n", APP_VERSION)
+	var groups []string
+	for group := range commands {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		var names []string
+		for name := range commands[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "  pidiver %s {%s} [flags] ...\n", group, strings.Join(names, "|"))
+	}
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]][os.Args[2]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	pidiver.SetLogger(pidiver.NewStdLogger(nil, pidiver.LevelInfo))
+	if err := cmd(os.Args[3:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
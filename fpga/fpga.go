@@ -0,0 +1,271 @@
+// Package fpga configures the Altera FPGA of a PiDiver in passive serial mode by
+// bit-banging nCONFIG, DATA0, DCLK, nSTATUS and CONF_DONE. The pins are accessed
+// through the GPIO interface - the Linux GPIO character device is implemented by
+// Chip, backends can use their own GPIO library.
+package fpga
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shufps/pidiver/bitstream"
+	"github.com/shufps/pidiver/pidiver"
+)
+
+const (
+	DEFAULT_RESET_PULSE       = 10 * time.Millisecond
+	DEFAULT_RESET_TIMEOUT     = 100 * time.Millisecond
+	DEFAULT_STATUS_TIMEOUT    = 100 * time.Millisecond
+	DEFAULT_CONF_DONE_TIMEOUT = 100 * time.Millisecond
+
+	// check nSTATUS for configuration errors every n bytes
+	STATUS_CHECK_INTERVAL = 4096
+)
+
+var (
+	ErrNoReset       = errors.New("fpga didn't enter reset (nSTATUS and CONF_DONE stay high)")
+	ErrNotReady      = errors.New("fpga not ready for configuration (nSTATUS stays low)")
+	ErrConfigError   = errors.New("fpga reported a configuration error (nSTATUS low)")
+	ErrNotConfigured = fmt.Errorf("%w after sending the core (CONF_DONE stays low)", pidiver.ErrNotConfigured)
+)
+
+type GPIO interface {
+	Input(pin int) error
+	Output(pin int, high bool) error
+	Set(pin int, high bool) error
+	Get(pin int) (bool, error)
+}
+
+type Pins struct {
+	NConfig  int
+	Data0    int
+	DCK      int
+	NStatus  int
+	ConfDone int
+}
+
+func BoardPins(board *pidiver.BoardProfile) Pins {
+	return Pins{
+		NConfig:  board.NConfig,
+		Data0:    board.Data0,
+		DCK:      board.DCK,
+		NStatus:  board.NStatus,
+		ConfDone: board.ConfDone,
+	}
+}
+
+type Configurator struct {
+	GPIO GPIO
+	Pins Pins
+
+	ResetPulse      time.Duration // nCONFIG low
+	ResetTimeout    time.Duration // wait for nSTATUS or CONF_DONE low after nCONFIG low
+	StatusTimeout   time.Duration // wait for nSTATUS high after nCONFIG high
+	ConfDoneTimeout time.Duration // wait for CONF_DONE high after the last byte
+
+	OnEvent pidiver.EventHandler // progress of Configure (Init takes it from the config if nil)
+	Logger  pidiver.Logger       // nil: logger of the config in Init or pidiver.GetLogger
+}
+
+func (c *Configurator) logger() pidiver.Logger {
+	if c.Logger == nil {
+		return pidiver.GetLogger()
+	}
+	return c.Logger
+}
+
+func NewConfigurator(gpio GPIO, pins Pins) *Configurator {
+	return &Configurator{
+		GPIO:            gpio,
+		Pins:            pins,
+		ResetPulse:      DEFAULT_RESET_PULSE,
+		ResetTimeout:    DEFAULT_RESET_TIMEOUT,
+		StatusTimeout:   DEFAULT_STATUS_TIMEOUT,
+		ConfDoneTimeout: DEFAULT_CONF_DONE_TIMEOUT,
+	}
+}
+
+// FPGA is configured when CONF_DONE is high
+func (c *Configurator) IsConfigured() (bool, error) {
+	if err := c.GPIO.Input(c.Pins.ConfDone); err != nil {
+		return false, err
+	}
+	return c.GPIO.Get(c.Pins.ConfDone)
+}
+
+// configure the FPGA with config.ConfigFile if it isn't configured or ForceConfigure is set
+func (c *Configurator) Init(config *pidiver.PiDiverConfig) error {
+	configured, err := c.IsConfigured()
+	if err != nil {
+		return err
+	}
+	if configured && !config.ForceConfigure {
+		return nil
+	}
+	if c.OnEvent == nil {
+		c.OnEvent = config.OnEvent
+	}
+	if c.Logger == nil {
+		c.Logger = pidiver.ConfigLogger(config)
+	}
+	c.logger().Log(pidiver.LevelInfo, "fpga not configured (or force selected) ... configuring ...")
+	return c.ConfigureFile(config.ConfigFile)
+}
+
+// error if CONF_DONE is low
+func (c *Configurator) CheckConfigured() error {
+	configured, err := c.IsConfigured()
+	if err != nil {
+		return err
+	}
+	if !configured {
+		return fmt.Errorf("%w (CONF_DONE low)", pidiver.ErrNotConfigured)
+	}
+	return nil
+}
+
+// configure the FPGA if the board has all pins for it, otherwise only check that
+// it is configured - boards without CONF_DONE pin can't be checked
+func InitBoard(gpio GPIO, board *pidiver.BoardProfile, config *pidiver.PiDiverConfig) error {
+	c := NewConfigurator(gpio, BoardPins(board))
+	if board.CanConfigure() {
+		return c.Init(config)
+	}
+	if board.ConfDone < 0 {
+		return nil
+	}
+	return c.CheckConfigured()
+}
+
+func (c *Configurator) ConfigureFile(filename string) error {
+	core, err := bitstream.Load(filename, "")
+	if err != nil {
+		return err
+	}
+	c.logger().Log(pidiver.LevelInfo, "core loaded", pidiver.F("file", filename), pidiver.F("size", core.Size()), pidiver.F("sha256", core.Checksum()))
+	return c.Configure(core.Data)
+}
+
+// wait until pin has level or timeout
+func (c *Configurator) waitFor(pin int, high bool, timeout time.Duration) (bool, error) {
+	start := time.Now()
+	for {
+		level, err := c.GPIO.Get(pin)
+		if err != nil {
+			return false, err
+		}
+		if level == high {
+			return true, nil
+		}
+		if time.Since(start) > timeout {
+			return false, nil
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+func (c *Configurator) setupPins() error {
+	for _, pin := range []int{c.Pins.NStatus, c.Pins.ConfDone} {
+		if err := c.GPIO.Input(pin); err != nil {
+			return err
+		}
+	}
+	for _, pin := range []struct {
+		pin  int
+		high bool
+	}{{c.Pins.DCK, false}, {c.Pins.Data0, false}, {c.Pins.NConfig, true}} {
+		if err := c.GPIO.Output(pin.pin, pin.high); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passive serial configuration
+func (c *Configurator) Configure(data []byte) (err error) {
+	if len(data) == 0 {
+		return errors.New("empty core file")
+	}
+	progress := pidiver.NewProgress(c.OnEvent, c.logger(), "", pidiver.PhaseConfigure, int64(len(data)))
+	defer func() { progress.Done(err) }()
+
+	if err := c.setupPins(); err != nil {
+		return err
+	}
+
+	// pulling nCONFIG to low resets the FPGA
+	if err := c.GPIO.Set(c.Pins.NConfig, false); err != nil {
+		return err
+	}
+	time.Sleep(c.ResetPulse)
+
+	start := time.Now()
+	for {
+		status, err := c.GPIO.Get(c.Pins.NStatus)
+		if err != nil {
+			return err
+		}
+		confDone, err := c.GPIO.Get(c.Pins.ConfDone)
+		if err != nil {
+			return err
+		}
+		if !status || !confDone {
+			break
+		}
+		if time.Since(start) > c.ResetTimeout {
+			return fmt.Errorf("%w after %v", ErrNoReset, c.ResetTimeout)
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+
+	if err := c.GPIO.Set(c.Pins.NConfig, true); err != nil {
+		return err
+	}
+	if ok, err := c.waitFor(c.Pins.NStatus, true, c.StatusTimeout); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%w after %v", ErrNotReady, c.StatusTimeout)
+	}
+
+	c.logger().Log(pidiver.LevelInfo, "configuring ...")
+	for index, value := range data {
+		for i := uint8(0); i < 8; i++ {
+			if err := c.GPIO.Set(c.Pins.Data0, (value>>i)&0x1 != 0); err != nil {
+				return err
+			}
+			if err := c.GPIO.Set(c.Pins.DCK, true); err != nil {
+				return err
+			}
+			if err := c.GPIO.Set(c.Pins.DCK, false); err != nil {
+				return err
+			}
+		}
+		confDone, err := c.GPIO.Get(c.Pins.ConfDone)
+		if err != nil {
+			return err
+		}
+		if confDone {
+			break
+		}
+		if (index+1)%STATUS_CHECK_INTERVAL == 0 {
+			progress.Update(int64(index + 1))
+			if status, err := c.GPIO.Get(c.Pins.NStatus); err != nil {
+				return err
+			} else if !status {
+				return fmt.Errorf("%w at byte %d", ErrConfigError, index)
+			}
+		}
+	}
+
+	if ok, err := c.waitFor(c.Pins.ConfDone, true, c.ConfDoneTimeout); err != nil {
+		return err
+	} else if !ok {
+		if status, err := c.GPIO.Get(c.Pins.NStatus); err == nil && !status {
+			return ErrConfigError
+		}
+		return fmt.Errorf("%w after %v", ErrNotConfigured, c.ConfDoneTimeout)
+	}
+	c.logger().Log(pidiver.LevelInfo, "configure done")
+	return nil
+}
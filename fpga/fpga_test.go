@@ -0,0 +1,173 @@
+package fpga
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/shufps/pidiver/pidiver"
+)
+
+var testPins = Pins{NConfig: 1, Data0: 2, DCK: 3, NStatus: 4, ConfDone: 5}
+
+// FPGA in passive serial mode behind fake GPIO pins
+type fakeFPGA struct {
+	noReset     bool // ignores nCONFIG
+	notReady    bool // nSTATUS stays low after the reset
+	failAt      int  // nSTATUS goes low after this many bytes (0: never)
+	neverDone   bool // CONF_DONE stays low
+	coreSize    int
+	pins        map[int]bool
+	outputs     map[int]bool
+	received    []byte
+	bits        int
+	status      bool
+	confDone    bool
+	resetCycles int
+}
+
+func newFakeFPGA(coreSize int) *fakeFPGA {
+	return &fakeFPGA{coreSize: coreSize, pins: make(map[int]bool), outputs: make(map[int]bool), status: true, confDone: true}
+}
+
+func (f *fakeFPGA) Input(pin int) error {
+	f.outputs[pin] = false
+	return nil
+}
+
+func (f *fakeFPGA) Output(pin int, high bool) error {
+	f.outputs[pin] = true
+	return f.Set(pin, high)
+}
+
+func (f *fakeFPGA) Set(pin int, high bool) error {
+	if !f.outputs[pin] {
+		return errors.New("pin is no output")
+	}
+	rising := high && !f.pins[pin]
+	f.pins[pin] = high
+	switch {
+	case pin == testPins.NConfig && !f.noReset:
+		if !high {
+			f.status, f.confDone = false, false
+			f.received, f.bits = nil, 0
+			f.resetCycles++
+		} else {
+			f.status = !f.notReady
+		}
+	case pin == testPins.DCK && rising && f.status && !f.confDone:
+		if f.bits%8 == 0 {
+			f.received = append(f.received, 0)
+		}
+		if f.pins[testPins.Data0] {
+			f.received[len(f.received)-1] |= 1 << uint(f.bits%8)
+		}
+		f.bits++
+		if f.failAt > 0 && f.bits == f.failAt*8 {
+			f.status = false
+		}
+		if !f.neverDone && f.bits == f.coreSize*8 {
+			f.confDone = true
+		}
+	}
+	return nil
+}
+
+func (f *fakeFPGA) Get(pin int) (bool, error) {
+	switch pin {
+	case testPins.NStatus:
+		return f.status, nil
+	case testPins.ConfDone:
+		return f.confDone, nil
+	}
+	return false, errors.New("pin not readable")
+}
+
+func newTestConfigurator(f *fakeFPGA) *Configurator {
+	c := NewConfigurator(f, testPins)
+	c.ResetPulse = time.Millisecond
+	c.ResetTimeout = 5 * time.Millisecond
+	c.StatusTimeout = 5 * time.Millisecond
+	c.ConfDoneTimeout = 5 * time.Millisecond
+	return c
+}
+
+func testCore(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestConfigure(t *testing.T) {
+	data := testCore(3 * STATUS_CHECK_INTERVAL)
+	f := newFakeFPGA(len(data))
+	c := newTestConfigurator(f)
+
+	if err := c.Configure(data); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.received) != string(data) || f.resetCycles != 1 {
+		t.Errorf("received %d bytes after %d resets", len(f.received), f.resetCycles)
+	}
+	if configured, err := c.IsConfigured(); err != nil || !configured {
+		t.Errorf("not configured: %v", err)
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	data := testCore(2 * STATUS_CHECK_INTERVAL)
+	for _, test := range []struct {
+		name  string
+		setup func(f *fakeFPGA)
+		err   error
+	}{
+		{"no reset", func(f *fakeFPGA) { f.noReset = true }, ErrNoReset},
+		{"not ready", func(f *fakeFPGA) { f.notReady = true }, ErrNotReady},
+		{"config error", func(f *fakeFPGA) { f.failAt = 100 }, ErrConfigError},
+		{"conf done timeout", func(f *fakeFPGA) { f.neverDone = true }, ErrNotConfigured},
+	} {
+		f := newFakeFPGA(len(data))
+		test.setup(f)
+		err := newTestConfigurator(f).Configure(data)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	// callers of the backends check the error of the pidiver package
+	f := newFakeFPGA(len(data))
+	f.neverDone = true
+	if err := newTestConfigurator(f).Configure(data); !errors.Is(err, pidiver.ErrNotConfigured) {
+		t.Errorf("conf done timeout: %v", err)
+	}
+}
+
+func TestInitBoard(t *testing.T) {
+	board := &pidiver.BoardProfile{NConfig: testPins.NConfig, Data0: testPins.Data0, DCK: testPins.DCK, NStatus: testPins.NStatus, ConfDone: testPins.ConfDone}
+	noConfig := *board
+	noConfig.NConfig = -1
+	noConfDone := noConfig
+	noConfDone.ConfDone = -1
+
+	for _, test := range []struct {
+		name       string
+		board      *pidiver.BoardProfile
+		configured bool
+		err        error
+	}{
+		{"configured", board, true, nil},
+		{"can't configure", &noConfig, true, nil},
+		{"can't configure - not configured", &noConfig, false, pidiver.ErrNotConfigured},
+		{"can't check", &noConfDone, false, nil},
+	} {
+		f := newFakeFPGA(16)
+		f.confDone = test.configured
+		err := InitBoard(f, test.board, &pidiver.PiDiverConfig{})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if f.resetCycles != 0 {
+			t.Errorf("%s: fpga was reset", test.name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package fpga
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/shufps/pidiver/pidiver"
+)
+
+// linux/gpio.h (v1 ABI)
+const (
+	GPIOHANDLES_MAX           = 64
+	GPIOHANDLE_REQUEST_INPUT  = 1 << 0
+	GPIOHANDLE_REQUEST_OUTPUT = 1 << 1
+
+	GPIO_CONSUMER = "pidiver"
+
+	DEFAULT_GPIOCHIP = "/dev/gpiochip0"
+)
+
+var (
+	GPIO_GET_LINEHANDLE_IOCTL        = iowr(0x03, 364) // struct gpiohandle_request
+	GPIOHANDLE_GET_LINE_VALUES_IOCTL = iowr(0x08, 64)  // struct gpiohandle_data
+	GPIOHANDLE_SET_LINE_VALUES_IOCTL = iowr(0x09, 64)
+)
+
+func iowr(nr uintptr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | 0xb4<<8 | nr
+}
+
+type gpiohandleRequest struct {
+	LineOffsets   [GPIOHANDLES_MAX]uint32
+	Flags         uint32
+	DefaultValues [GPIOHANDLES_MAX]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpiohandleData struct {
+	Values [GPIOHANDLES_MAX]uint8
+}
+
+// Chip is the GPIO interface on /dev/gpiochipN. Every line is requested
+// separately when its direction is set.
+type Chip struct {
+	lock    sync.Mutex
+	file    *os.File
+	handles map[int]*os.File
+}
+
+func OpenChip(path string) (*Chip, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Chip{file: file, handles: make(map[int]*os.File)}, nil
+}
+
+func (c *Chip) request(pin int, flags uint32, high bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if handle, ok := c.handles[pin]; ok {
+		handle.Close()
+		delete(c.handles, pin)
+	}
+
+	req := gpiohandleRequest{Flags: flags, Lines: 1}
+	req.LineOffsets[0] = uint32(pin)
+	if high {
+		req.DefaultValues[0] = 1
+	}
+	copy(req.ConsumerLabel[:], GPIO_CONSUMER)
+	if err := ioctl(c.file.Fd(), GPIO_GET_LINEHANDLE_IOCTL, &req); err != nil {
+		return fmt.Errorf("couldn't request gpio line %d: %v", pin, err)
+	}
+	c.handles[pin] = os.NewFile(uintptr(req.Fd), fmt.Sprintf("gpio%d", pin))
+	return nil
+}
+
+func (c *Chip) handle(pin int) (*os.File, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	handle, ok := c.handles[pin]
+	if !ok {
+		return nil, fmt.Errorf("gpio line %d not requested", pin)
+	}
+	return handle, nil
+}
+
+func (c *Chip) Input(pin int) error {
+	return c.request(pin, GPIOHANDLE_REQUEST_INPUT, false)
+}
+
+func (c *Chip) Output(pin int, high bool) error {
+	return c.request(pin, GPIOHANDLE_REQUEST_OUTPUT, high)
+}
+
+func (c *Chip) Set(pin int, high bool) error {
+	handle, err := c.handle(pin)
+	if err != nil {
+		return err
+	}
+	var data gpiohandleData
+	if high {
+		data.Values[0] = 1
+	}
+	return ioctl(handle.Fd(), GPIOHANDLE_SET_LINE_VALUES_IOCTL, &data)
+}
+
+func (c *Chip) Get(pin int) (bool, error) {
+	handle, err := c.handle(pin)
+	if err != nil {
+		return false, err
+	}
+	var data gpiohandleData
+	if err := ioctl(handle.Fd(), GPIOHANDLE_GET_LINE_VALUES_IOCTL, &data); err != nil {
+		return false, err
+	}
+	return data.Values[0] != 0, nil
+}
+
+// releases all lines
+func (c *Chip) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for pin, handle := range c.handles {
+		handle.Close()
+		delete(c.handles, pin)
+	}
+	return c.file.Close()
+}
+
+// configure the FPGA through the gpio chip if needed (see InitBoard)
+func InitGPIOChip(path string, board *pidiver.BoardProfile, config *pidiver.PiDiverConfig) error {
+	chip, err := OpenChip(path)
+	if err != nil {
+		return err
+	}
+	defer chip.Close()
+	return InitBoard(chip, board, config)
+}
@@ -0,0 +1,21 @@
+package fpga
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, req uintptr, arg interface{}) error {
+	var ptr unsafe.Pointer
+	switch v := arg.(type) {
+	case *gpiohandleRequest:
+		ptr = unsafe.Pointer(v)
+	case *gpiohandleData:
+		ptr = unsafe.Pointer(v)
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(ptr))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package fpga
+
+import "errors"
+
+func ioctl(fd uintptr, req uintptr, arg interface{}) error {
+	return errors.New("gpio character device is only supported on linux")
+}
@@ -8,6 +8,7 @@ require (
 	github.com/iotaledger/iota.go v1.0.0-beta
 	github.com/lunixbochs/struc v0.0.0-20180408203800-02e4c2afbb2a
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	github.com/pelletier/go-toml v1.2.0
 	github.com/shufps/bcm2835 v0.0.0-20180618104835-f7c55da42985
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.3.1
@@ -2,18 +2,18 @@ package main
 
 import (
 	//	"flag"
+	"fmt"
 	"log"
 	"math/rand"
+	"time"
 
 	"github.com/iotaledger/iota.go/consts"
 	"github.com/iotaledger/iota.go/curl"
 	"github.com/iotaledger/iota.go/pow"
 	"github.com/iotaledger/iota.go/trinary"
+	_ "github.com/shufps/pidiver/backends"
 	"github.com/shufps/pidiver/pidiver"
-	"github.com/shufps/pidiver/raspberry"
 
-	//	"github.com/shufps/pidiver/orange_pi_pc"
-	//	"github.com/shufps/pidiver/raspberry_wiringPi"
 	flag "github.com/spf13/pflag"
 )
 
@@ -21,52 +21,51 @@ const APP_VERSION = "0.1"
 
 // The flag package provides a default help printer via -h switch
 var configFile *string = flag.StringP("fpga.core", "f", "../pidiver1.1.rbf", "Core file to upload to FPGA")
-var device *string = flag.StringP("usb.device", "d", "/dev/ttyACM0", "Device file for usb communication")
-
-//var diver *string = flag.StringP("pow.type", "t", "usbdiver", "'pidiver', 'usbdiver', 'pidiver_wp")
-//var diver *string = flag.StringP("pow.type", "t", "usbdiver", "'pidiver', 'usbdiver', 'orange_pi_pc")
-var diver *string = flag.StringP("pow.type", "t", "usbdiver", "'pidiver', 'usbdiver', 'powchip'")
+var devices *[]string = flag.StringSliceP("usb.device", "d", []string{"/dev/ttyACM0"}, "Device files for usb communication (comma separated for multiple devices)")
+var board *string = flag.StringP("pow.board", "b", "", fmt.Sprintf("board profile - one of %q or a .json/.toml file", pidiver.Boards()))
+var diver *string = flag.StringP("pow.type", "t", "usbdiver", fmt.Sprintf("one of %q", pidiver.DiverTypes()))
+var recoverInterval *time.Duration = flag.DurationP("pow.recover", "r", time.Minute, "interval for re-initializing failed devices (0: never)")
+var debug *bool = flag.BoolP("log.debug", "v", false, "log debug messages of the devices")
 
 func main() {
 	flag.Parse() // Scan the arguments list
+	level := pidiver.LevelInfo
+	if *debug {
+		level = pidiver.LevelDebug
+	}
+	pidiver.SetLogger(pidiver.NewStdLogger(nil, level))
 
-	config := pidiver.PiDiverConfig{
-		Device:         *device,
-		ConfigFile:     *configFile,
-		ForceFlash:     false,
-		ForceConfigure: false,
-		UseCRC:         true,
-		UseSharedLock:  true}
+	var divers []pidiver.Diver
+	for _, device := range *devices {
+		config := pidiver.PiDiverConfig{
+			Device:         device,
+			ConfigFile:     *configFile,
+			Board:          *board,
+			ForceFlash:     false,
+			ForceConfigure: false,
+			UseCRC:         true,
+			UseSharedLock:  true}
 
-	var powFuncs []pow.ProofOfWorkFunc
-	var err error
-	if *diver == "usbdiver" {
-		usb := pidiver.USBDiver{Config: &config}
-		err = usb.InitUSBDiver()
-		powFuncs = append(powFuncs, usb.PowUSBDiver)
-	} else if *diver == "powchip" {
-		usb := pidiver.USBDiver{Config: &config}
-		powchip := pidiver.PoWChipDiver{USBDiver: &usb}
-		err = powchip.USBDiver.InitUSBDiver()
-		powFuncs = append(powFuncs, powchip.PowPoWChipDiver)
-		//	} else if *diver == "orange_pi_pc" {
-		//		raspi := pidiver.PiDiver{LLStruct: orange_pi_pc.GetLowLevel(), Config: &config}
-		//		err = raspi.InitPiDiver()
-		//		powFuncs = append(powFuncs, raspi.PowPiDiver)
-		//	} else if *diver == "pidiver_wp" {
-		//		raspi := pidiver.PiDiver{LLStruct: raspberry_wiringPi.GetLowLevel(), Config: &config}
-		//		err = raspi.InitPiDiver()
-		//		powFuncs = append(powFuncs, raspi.PowPiDiver)
-	} else if *diver == "pidiver" {
-		raspi := pidiver.PiDiver{LLStruct: raspberry.GetLowLevel(), Config: &config}
-		err = raspi.InitPiDiver()
-		powFuncs = append(powFuncs, raspi.PowPiDiver)
-	} else {
-		log.Fatalf("unknown type %s\n", *diver)
+		d, err := pidiver.NewDiver(*diver, &config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		divers = append(divers, d)
 	}
-	if err != nil {
+
+	pool := pidiver.NewDiverPool(divers...)
+	if err := pool.Init(); err != nil {
 		log.Fatal(err)
 	}
+	defer pool.Close()
+	pool.StartRecovery(*recoverInterval)
+
+	// one worker per device - the pool hands the transactions to idle devices
+	var powFuncs []pow.ProofOfWorkFunc
+	for i := 0; i < pool.Size(); i++ {
+		powFuncs = append(powFuncs, pool.PoW)
+	}
+
 	channel := make(chan trinary.Trytes, 100)
 	for worker := 0; worker < len(powFuncs); worker++ {
 		go func(id int, mwm int, channel chan trinary.Trytes) {
@@ -80,7 +79,7 @@ func main() {
 					ret, err := powFuncs[id](trytes, mwm)
 					if err != nil {
 						//log.Fatalf("Error: %g", err)
-						log.Printf("[%d] crc error", id)
+						log.Printf("[%d] %v", id, err)
 						break
 						//						continue
 					}
@@ -88,7 +87,7 @@ func main() {
 					// verify result ... copy nonce to transaction
 					trytes = trytes[:consts.NonceTrinaryOffset/3] + ret[0:consts.NonceTrinarySize/3]
 					//				println(trytes)
-					hash, _ := curl.HashTrytes(trytes)
+					hash := curl.HashTrytes(trytes)
 					tritsHash, _ := trinary.TrytesToTrits(hash)
 					for i := 0; i < mwm; i++ {
 						if tritsHash[len(tritsHash)-1-i] != 0 {
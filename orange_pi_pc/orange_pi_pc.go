@@ -14,11 +14,9 @@ package orange_pi_pc
 
 // wiringPi Numbers
 //#define SPI_CS         21
-#define GPIO_nCONFIG   8
-#define GPIO_DATA0     9
-#define GPIO_DCK       7
-#define GPIO_nSTATUS   0
-#define GPIO_CONFDONE  11
+
+// set from the board profile
+int spi_channel = 1;
 
 uint32_t swap(uint32_t x) {
         return ((x & 0xff000000) >> 24) |
@@ -30,7 +28,7 @@ uint32_t swap(uint32_t x) {
 void send(uint32_t data) {                                                                                                                                                                                                       
         uint32_t bytedata = swap(data);                                                                                                                                                                                          
 //        digitalWrite(SPI_CS, 0);                                                                                                                                                                                                 
-	wiringPiSPIDataRW(1, (char*) &bytedata, 4);
+	wiringPiSPIDataRW(spi_channel, (char*) &bytedata, 4);
 //        digitalWrite(SPI_CS, 1);                                                                                                                                                                                                 
 //	printf("sent: %08x\n", data);
 }                                                                                                                                                                                                                                
@@ -40,11 +38,11 @@ uint32_t sendReceive(uint32_t data) {
         uint32_t bytedata = swap(data);                                                                                                                                                                                          
         uint32_t bytedata_read = 0x00000000;                                                                                                                                                                                             
 //        digitalWrite(SPI_CS, 0);
-	wiringPiSPIDataRW(1, (char*) &bytedata, 4);
+	wiringPiSPIDataRW(spi_channel, (char*) &bytedata, 4);
 //        digitalWrite(SPI_CS, 1);
 
 //        digitalWrite(SPI_CS, 0);
-	wiringPiSPIDataRW(1, (char*) &bytedata_read, 4);
+	wiringPiSPIDataRW(spi_channel, (char*) &bytedata_read, 4);
 //        digitalWrite(SPI_CS, 1);
 
 //	printf("sent: %08x received %08x\n", data, swap(bytedata_read));
@@ -62,28 +60,23 @@ import "C"
 
 
 import (
-        "bufio"
         "errors"
+        "fmt"
         "unsafe"
-        "log"
-        "os"
-        "time"
 //	"encoding/binary"
+        "github.com/shufps/pidiver/fpga"
         "github.com/shufps/pidiver/pidiver"
 
 )
 
 const (
-        // wiringPi Numbers
-//        SPI_CS        = 21
-        GPIO_nCONFIG  = 8
-        GPIO_DATA0    = 9
-        GPIO_DCK      = 7
-        GPIO_nSTATUS  = 0
-        GPIO_CONFDONE = 11
+        DEFAULT_BOARD = "orange_pi_pc"
 )
 
 func init() {
+        pidiver.RegisterDiver("orange_pi_pc", func(config *pidiver.PiDiverConfig) (pidiver.Diver, error) {
+                return &pidiver.PiDiver{LLStruct: GetLowLevel(), Config: config}, nil
+        })
 }
 
 func GetLowLevel() pidiver.LLStruct {
@@ -165,108 +158,61 @@ func gpioFsel(pin int, mode int) {
 func initWiringPi() error {
         ret := int(C.wiringPiSetup())
         if ret == -1 {
-                return errors.New("error init wiringpi")
+                return fmt.Errorf("%w: error init wiringpi", pidiver.ErrDeviceGone)
         }
         return nil
 }
 
-func configureFPGA(filename string) error {
-        f, err := os.Open(filename)
-        if err != nil {
-                return err
-        }
-        defer f.Close()
-
-        stats, statsErr := f.Stat()
-        if statsErr != nil {
-                return err
-        }
-
-        size := stats.Size()
-        data := make([]byte, size)
-        _, err = bufio.NewReader(f).Read(data)
-        if err != nil {
-                return err
-        }
-
-        log.Printf("bytes read: %d\n", size)
-        gpioClr(GPIO_DCK)
-
-        /* pulling FPGA_CONFIG to low resets the FPGA */
-        gpioClr(GPIO_nCONFIG)   /* FPGA config => low */
-        time.Sleep(time.Millisecond * 10) /* give it some time to do its reset stuff */
+// wiringPi as GPIO for the fpga configurator
+type wiringPiGPIO struct{}
 
-        for {
-                if (gpioLev(GPIO_nSTATUS) != 0) && (gpioLev(GPIO_CONFDONE) != 0) {
-                        continue
-                }
-                break
-        }
+func (wiringPiGPIO) Input(pin int) error {
+        gpioFsel(pin, 0)
+        return nil
+}
 
-        gpioSet(GPIO_nCONFIG)
-        for {
-                if gpioLev(GPIO_nSTATUS) == 0 {
-                        continue
-                }
-                break
-        }
+func (wiringPiGPIO) Output(pin int, high bool) error {
+        wiringPiGPIO{}.Set(pin, high)
+        gpioFsel(pin, 1)
+        return nil
+}
 
-        index := int64(0)
-        log.Printf("configuring ...")
-        for {
-                //              log.Printf("index %d\n", index)
-                var value uint8 = data[index]
-                index++
-                for i := uint8(0); i < 8; i++ {
-                        if (value>>i)&0x1 != 0 {
-                                gpioSet(GPIO_DATA0)
-                        } else {
-                                gpioClr(GPIO_DATA0)
-                        }
-                        gpioSet(GPIO_DCK)
-                        gpioClr(GPIO_DCK)
-                }
-                if gpioLev(GPIO_CONFDONE) == 0 && index < size {
-                        continue
-                }
-                break
+func (wiringPiGPIO) Set(pin int, high bool) error {
+        if high {
+                gpioSet(pin)
+        } else {
+                gpioClr(pin)
         }
-        log.Printf("configure done")
-
         return nil
 }
 
+func (wiringPiGPIO) Get(pin int) (bool, error) {
+        return gpioLev(pin) != 0, nil
+}
+
 func llInit(config *pidiver.PiDiverConfig) error {
-        err := initWiringPi()
+        board, err := pidiver.ConfigBoard(config, DEFAULT_BOARD)
         if err != nil {
                 return err
         }
+        if board.SPIMode != 0 || board.LSBFirst() || board.CS >= 0 {
+                return errors.New("wiringOP only supports spi mode 0, msb first and hardware chip select")
+        }
 
-        log.Printf("Using WiringPi")
-        // configure pins for configuring
-        gpioFsel(GPIO_CONFDONE, 0)
-
-        if config.ForceConfigure || gpioLev(GPIO_CONFDONE) == 0 {
-                gpioClr(GPIO_DCK)
-                gpioSet(GPIO_nCONFIG)
-                gpioFsel(GPIO_DATA0, 1)
-                gpioFsel(GPIO_DCK, 1)
-                gpioFsel(GPIO_nCONFIG, 1)
-                gpioFsel(GPIO_nSTATUS, 0)
-
-                log.Printf("fpga not configured (or force selected ... configuring ...")
-                err := configureFPGA(config.ConfigFile)
-                if err != nil {
-                        return err
-                }
+        err = initWiringPi()
+        if err != nil {
+                return err
         }
 
-        if gpioLev(GPIO_CONFDONE) == 0 {
-                return errors.New("error configuring!")
+        pidiver.ConfigLogger(config).Log(pidiver.LevelInfo, "using WiringPi")
+        // configure fpga if needed
+        if err := fpga.InitBoard(wiringPiGPIO{}, board, config); err != nil {
+                return err
         }
 
         /* init spi interface */
-        C.wiringPiSPISetup (C.int(1), C.int(10000000))
+        C.spi_channel = C.int(board.SPIChipSelect)
+        C.wiringPiSPISetup (C.int(board.SPIChipSelect), C.int(board.SPIClock))
 /*
         gpioFsel(SPI_CS, 1)
 
@@ -0,0 +1,183 @@
+package pidiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+)
+
+// board profiles describe how the FPGA is connected: SPI settings, chip select
+// and the pins for configuring the FPGA. Backends load the profile named in
+// PiDiverConfig.Board - a built-in profile or a json/toml file. Pins are numbered
+// like the GPIO library of the backend uses them, -1 means not connected.
+
+const (
+	BIT_ORDER_MSB = "msb"
+	BIT_ORDER_LSB = "lsb"
+)
+
+type BoardProfile struct {
+	Name string `json:"name" toml:"name"`
+
+	SPIBus        int    `json:"spiBus" toml:"spiBus"`
+	SPIChipSelect int    `json:"spiChipSelect" toml:"spiChipSelect"` // hardware chip select (channel)
+	SPIMode       int    `json:"spiMode" toml:"spiMode"`             // 0-3
+	SPIBitOrder   string `json:"spiBitOrder" toml:"spiBitOrder"`     // msb or lsb
+	SPIClock      int    `json:"spiClock" toml:"spiClock"`           // Hz
+
+	CS       int    `json:"cs" toml:"cs"` // chip select driven as gpio (-1: hardware chip select)
+	NConfig  int    `json:"nConfig" toml:"nConfig"`
+	Data0    int    `json:"data0" toml:"data0"`
+	DCK      int    `json:"dck" toml:"dck"`
+	NStatus  int    `json:"nStatus" toml:"nStatus"`
+	ConfDone int    `json:"confDone" toml:"confDone"`
+	GPIOChip string `json:"gpioChip" toml:"gpioChip"` // gpio character device (spidev backend)
+}
+
+var (
+	boardsLock sync.Mutex
+	boards     = make(map[string]BoardProfile)
+)
+
+func init() {
+	// PiDiver hat on the Raspberry Pi (BCM numbers)
+	RegisterBoard(BoardProfile{
+		Name:          "raspberry",
+		SPIBus:        0,
+		SPIChipSelect: 0,
+		SPIMode:       0,
+		SPIBitOrder:   BIT_ORDER_MSB,
+		SPIClock:      7812500, // 250MHz / 32
+		CS:            5,
+		NConfig:       2,
+		Data0:         3,
+		DCK:           4,
+		NStatus:       17,
+		ConfDone:      7,
+		GPIOChip:      "/dev/gpiochip0",
+	})
+	// PiDiver hat on the Raspberry Pi (wiringPi numbers)
+	RegisterBoard(BoardProfile{
+		Name:          "raspberry_wiringpi",
+		SPIBus:        0,
+		SPIChipSelect: 0,
+		SPIMode:       0,
+		SPIBitOrder:   BIT_ORDER_MSB,
+		SPIClock:      10000000,
+		CS:            21,
+		NConfig:       8,
+		Data0:         9,
+		DCK:           7,
+		NStatus:       0,
+		ConfDone:      11,
+	})
+	// Orange Pi PC (wiringOP numbers)
+	RegisterBoard(BoardProfile{
+		Name:          "orange_pi_pc",
+		SPIBus:        0,
+		SPIChipSelect: 1,
+		SPIMode:       0,
+		SPIBitOrder:   BIT_ORDER_MSB,
+		SPIClock:      10000000,
+		CS:            -1,
+		NConfig:       8,
+		Data0:         9,
+		DCK:           7,
+		NStatus:       0,
+		ConfDone:      11,
+	})
+}
+
+// add built-in profile
+func RegisterBoard(profile BoardProfile) {
+	boardsLock.Lock()
+	defer boardsLock.Unlock()
+	if _, ok := boards[profile.Name]; ok {
+		panic("board already registered: " + profile.Name)
+	}
+	boards[profile.Name] = profile
+}
+
+// names of the built-in profiles
+func Boards() []string {
+	boardsLock.Lock()
+	defer boardsLock.Unlock()
+	names := make([]string, 0, len(boards))
+	for name := range boards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load built-in profile or json/toml file
+func LoadBoard(name string) (*BoardProfile, error) {
+	boardsLock.Lock()
+	profile, ok := boards[name]
+	boardsLock.Unlock()
+	if ok {
+		return &profile, nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext != ".json" && ext != ".toml" {
+		return nil, fmt.Errorf("unknown board: %s (one of %q or a .json/.toml file)", name, Boards())
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	profile = BoardProfile{}
+	if ext == ".json" {
+		err = json.Unmarshal(data, &profile)
+	} else {
+		err = toml.Unmarshal(data, &profile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse board %s: %v", name, err)
+	}
+	if profile.Name == "" {
+		profile.Name = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("board %s: %v", name, err)
+	}
+	return &profile, nil
+}
+
+// profile of config.Board or defaultBoard if not set
+func ConfigBoard(config *PiDiverConfig, defaultBoard string) (*BoardProfile, error) {
+	if config.Board == "" {
+		return LoadBoard(defaultBoard)
+	}
+	return LoadBoard(config.Board)
+}
+
+func (b *BoardProfile) Validate() error {
+	if b.SPIMode < 0 || b.SPIMode > 3 {
+		return errors.New("spiMode has to be 0-3")
+	}
+	if b.SPIBitOrder != "" && b.SPIBitOrder != BIT_ORDER_MSB && b.SPIBitOrder != BIT_ORDER_LSB {
+		return errors.New("spiBitOrder has to be msb or lsb")
+	}
+	if b.SPIClock <= 0 {
+		return errors.New("spiClock missing")
+	}
+	return nil
+}
+
+func (b *BoardProfile) LSBFirst() bool {
+	return b.SPIBitOrder == BIT_ORDER_LSB
+}
+
+// all pins for configuring the FPGA are connected
+func (b *BoardProfile) CanConfigure() bool {
+	return b.NConfig >= 0 && b.Data0 >= 0 && b.DCK >= 0 && b.NStatus >= 0 && b.ConfDone >= 0
+}
@@ -0,0 +1,83 @@
+package pidiver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltinBoards(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		cs        int
+		confDone  int
+		configure bool
+	}{
+		{"raspberry", 5, 7, true},
+		{"raspberry_wiringpi", 21, 11, true},
+		{"orange_pi_pc", -1, 11, true},
+	} {
+		board, err := LoadBoard(test.name)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if board.Name != test.name || board.CS != test.cs || board.ConfDone != test.confDone || board.CanConfigure() != test.configure {
+			t.Errorf("%s: %+v", test.name, board)
+		}
+		if err := board.Validate(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	if _, err := LoadBoard("unknown"); err == nil {
+		t.Error("unknown board loaded")
+	}
+}
+
+func TestLoadBoardFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		file    string
+		content string
+		board   BoardProfile // zero: error expected
+	}{
+		{"custom.json", `{"spiBus": 1, "spiMode": 3, "spiBitOrder": "lsb", "spiClock": 1000000, "cs": -1, "nConfig": -1, "data0": -1, "dck": -1, "nStatus": -1, "confDone": 6}`,
+			BoardProfile{Name: "custom", SPIBus: 1, SPIMode: 3, SPIBitOrder: BIT_ORDER_LSB, SPIClock: 1000000, CS: -1, NConfig: -1, Data0: -1, DCK: -1, NStatus: -1, ConfDone: 6}},
+		{"custom.toml", "name = \"hat\"\nspiClock = 500000\ncs = 8\nnConfig = 2\ndata0 = 3\ndck = 4\nnStatus = 17\nconfDone = 7\ngpioChip = \"/dev/gpiochip1\"\n",
+			BoardProfile{Name: "hat", SPIClock: 500000, CS: 8, NConfig: 2, Data0: 3, DCK: 4, NStatus: 17, ConfDone: 7, GPIOChip: "/dev/gpiochip1"}},
+		{"broken.json", `{"spiClock": `, BoardProfile{}},
+		{"mode.json", `{"spiClock": 1000000, "spiMode": 4}`, BoardProfile{}},
+		{"order.toml", "spiClock = 1000000\nspiBitOrder = \"middle\"\n", BoardProfile{}},
+		{"noclock.toml", "cs = 5\n", BoardProfile{}},
+	} {
+		path := filepath.Join(dir, test.file)
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		board, err := LoadBoard(path)
+		if test.board == (BoardProfile{}) {
+			if err == nil {
+				t.Errorf("%s: loaded %+v", test.file, board)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+		} else if *board != test.board {
+			t.Errorf("%s: %+v", test.file, board)
+		}
+	}
+	if _, err := LoadBoard(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing board file loaded")
+	}
+}
+
+func TestConfigBoard(t *testing.T) {
+	board, err := ConfigBoard(&PiDiverConfig{}, "raspberry")
+	if err != nil || board.Name != "raspberry" {
+		t.Errorf("default board: %v, %v", board, err)
+	}
+	board, err = ConfigBoard(&PiDiverConfig{Board: "orange_pi_pc"}, "raspberry")
+	if err != nil || board.Name != "orange_pi_pc" {
+		t.Errorf("config board: %v, %v", board, err)
+	}
+}
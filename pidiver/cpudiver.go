@@ -0,0 +1,214 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// bit-sliced Curl-P81 nonce search on the CPU (type "cpu"). Used where no
+// board is available - the nonce starts with CPU_NONCE_SIGNATURE instead of PIDIVER
+
+const (
+	CPU_NONCE_SIGNATURE = "CPUDIVER"
+	CPU_LANE_BITS       = 6 // log2(LANES)
+)
+
+func init() {
+	RegisterDiver("cpu", func(config *PiDiverConfig) (Diver, error) {
+		return &CPUDiver{Config: config}, nil
+	})
+}
+
+type CPUDiver struct {
+	Config  *PiDiverConfig
+	Threads int // number of goroutines (0: number of cpus)
+}
+
+// Diver interface
+func (c *CPUDiver) Init() error {
+	return nil
+}
+
+func (c *CPUDiver) PoW(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return c.PowCPUDiver(trytes, minWeight, parallelism...)
+}
+
+func (c *CPUDiver) PoWContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	return c.PowCPUDiverContext(ctx, trytes, minWeight, c.Threads)
+}
+
+func (c *CPUDiver) Info() DiverInfo {
+	return DiverInfo{
+		Type:     c.Config.Type,
+		Version:  runtime.GOARCH,
+		Parallel: uint32(c.threads(c.Threads) * LANES),
+	}
+}
+
+func (c *CPUDiver) Close() error {
+	return nil
+}
+
+func (c *CPUDiver) threads(threads int) int {
+	if threads <= 0 {
+		return runtime.NumCPU()
+	}
+	return threads
+}
+
+func (c *CPUDiver) progress(phase Phase) *Progress {
+	return NewProgress(c.Config.OnEvent, ConfigLogger(c.Config), c.Config.Device, phase, 0)
+}
+
+func (c *CPUDiver) log(level Level, msg string, fields ...Field) {
+	ConfigLogger(c.Config).Log(level, msg, fields...)
+}
+
+// do PoW - parallelism is the number of goroutines
+func (c *CPUDiver) PowCPUDiver(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	threads := c.Threads
+	if len(parallelism) > 0 {
+		threads = parallelism[0]
+	}
+	return c.PowCPUDiverContext(context.Background(), trytes, minWeight, threads)
+}
+
+// do PoW - stops searching when ctx is done
+func (c *CPUDiver) PowCPUDiverContext(ctx context.Context, trytes trinary.Trytes, minWeight int, threads int) (trinary.Trytes, error) {
+	report, err := c.powReport(ctx, trytes, minWeight, threads)
+	if err != nil {
+		return "", err
+	}
+	return report.Nonce, nil
+}
+
+// do PoW and return the nonce with diagnostics
+func (c *CPUDiver) PoWWithReport(ctx context.Context, trytes trinary.Trytes, minWeight int) (*PoWReport, error) {
+	return c.powReport(ctx, trytes, minWeight, c.Threads)
+}
+
+func (c *CPUDiver) powReport(ctx context.Context, trytes trinary.Trytes, minWeight int, threads int) (*PoWReport, error) {
+	if len(trytes) != 2673 {
+		return nil, errors.New("invalid transaction length")
+	}
+	if minWeight < 0 || minWeight > HASH_LENGTH {
+		return nil, errors.New("invalid min weight magnitude")
+	}
+	trits, err := trinary.TrytesToTrits(trytes)
+	if err != nil {
+		return nil, err
+	}
+
+	midStateStart := time.Now()
+	progress := c.progress(PhaseMidstate)
+	state := make(trinary.Trits, STATE_LENGTH)
+	for blocknr := 0; blocknr < 33; blocknr++ {
+		curlAbsorb(state, trits[blocknr*HASH_LENGTH:(blocknr+1)*HASH_LENGTH], blocknr != 32)
+	}
+	progress.Done(nil)
+	midStateEnd := time.Now()
+
+	fill := cpuLaneFiller()
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-finished:
+		}
+	}()
+
+	powStart := time.Now()
+	progress = c.progress(PhasePoW)
+	batch, lanes, found := searchNonce(state, minWeight, c.threads(threads), uint64(1)<<32, fill, stop)
+	powEnd := time.Now()
+
+	if ctx.Err() != nil {
+		progress.Done(ErrCancelled)
+		return nil, ErrCancelled
+	}
+	if !found {
+		err := errors.New("nonce counter overflow")
+		progress.Done(err)
+		return nil, err
+	}
+	progress.SetHashes((batch + 1) * LANES)
+	progress.Done(nil)
+
+	var lane uint32
+	for lanes&(1<<lane) == 0 {
+		lane++
+	}
+	nonceTrits := cpuNonceTrits(lane, uint32(batch))
+	nonce, err := trinary.TritsToTrytes(nonceTrits)
+	if err != nil {
+		return nil, err
+	}
+
+	report := newReport(c.Info(), minWeight)
+	report.Nonce = nonce
+	report.Midstate = midStateEnd.Sub(midStateStart)
+	report.Search = powEnd.Sub(powStart)
+	report.Total = time.Since(midStateStart)
+	report.Counter = uint32(batch)
+	report.Mask = 1 << lane
+	report.Parallel = uint32(c.threads(threads) * LANES) // lanes of all goroutines like Info
+	report.Hashes = (batch + 1) * LANES
+	c.log(LevelDebug, "found nonce", F("nonce", fmt.Sprintf("%08x", batch)), F("lane", lane))
+	c.log(LevelDebug, "pow done", F("time", report.Midstate+report.Search),
+		F("rate", fmt.Sprintf("%.2fMH/s", report.HashRate()/1000000.0)))
+	return report, nil
+}
+
+// nonce was found by the cpu backend
+func IsCPUNonce(nonce trinary.Trytes) bool {
+	return strings.HasPrefix(string(nonce), CPU_NONCE_SIGNATURE)
+}
+
+// nonce layout like assembleNonce: signature, lane index, zeros, 32 bit counter
+func cpuNonceTrits(lane uint32, counter uint32) trinary.Trits {
+	nonceTrits := make(trinary.Trits, NONCE_TRINARY_SIZE)
+
+	sig, _ := trinary.TrytesToTrits(CPU_NONCE_SIGNATURE)
+	copy(nonceTrits, sig)
+
+	for j := 0; j < CPU_LANE_BITS; j++ {
+		nonceTrits[len(sig)+j] = bitsToTrits(uint8((^lane>>uint32(j))&0x1), uint8((lane>>uint32(j))&0x1))
+	}
+	for i := 0; i < 32; i++ {
+		nonceTrits[NONCE_TRINARY_SIZE-32+i] = bitsToTrits(uint8((^counter>>uint32(i))&0x1), uint8((counter>>uint32(i))&0x1))
+	}
+	return nonceTrits
+}
+
+// one batch are all 64 lanes with the same counter
+func cpuLaneFiller() laneFiller {
+	// signature and lane index don't change
+	var prefixLo, prefixHi [NONCE_TRINARY_SIZE]uint64
+	for lane := uint(0); lane < LANES; lane++ {
+		trits := cpuNonceTrits(uint32(lane), 0)
+		for i := 0; i < NONCE_TRINARY_SIZE; i++ {
+			setLaneTrit(&prefixLo[i], &prefixHi[i], lane, trits[i])
+		}
+	}
+
+	return func(batch uint64, lo *[NONCE_TRINARY_SIZE]uint64, hi *[NONCE_TRINARY_SIZE]uint64) uint64 {
+		*lo = prefixLo
+		*hi = prefixHi
+		counter := uint32(batch)
+		for i := 0; i < 32; i++ {
+			lo[NONCE_TRINARY_SIZE-32+i] = -uint64((counter >> uint32(i)) & 0x1)
+			hi[NONCE_TRINARY_SIZE-32+i] = -uint64(((^counter) >> uint32(i)) & 0x1)
+		}
+		return ^uint64(0)
+	}
+}
@@ -0,0 +1,65 @@
+package pidiver
+
+import (
+	"context"
+	"testing"
+)
+
+func newTestCPUDiver(t *testing.T, threads int) *CPUDiver {
+	diver := &CPUDiver{Config: &PiDiverConfig{Type: "cpu"}, Threads: threads}
+	if err := diver.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diver.Close() })
+	return diver
+}
+
+func TestCPUDiverPoW(t *testing.T) {
+	for _, threads := range []int{1, 4} {
+		diver := newTestCPUDiver(t, threads)
+		for _, mwm := range []int{1, 9, 12} {
+			nonce, err := diver.PoW(testTrytes, mwm)
+			if err != nil {
+				t.Fatalf("threads %d, mwm %d: %v", threads, mwm, err)
+			}
+			checkNonce(t, testTrytes, nonce, mwm)
+			if !IsCPUNonce(nonce) {
+				t.Errorf("nonce %s has no cpu signature", nonce)
+			}
+		}
+	}
+}
+
+func TestCPUDiverReport(t *testing.T) {
+	diver := newTestCPUDiver(t, 2)
+	report, err := diver.PoWWithReport(context.Background(), testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, report.Nonce, 9)
+	if report.Parallel != 2*LANES || report.Hashes == 0 || report.Mask == 0 {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestCPUDiverCancel(t *testing.T) {
+	diver := newTestCPUDiver(t, 0)
+	checkCancel(t, diver)
+
+	// a cancel doesn't affect the next search
+	nonce, err := diver.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+}
+
+func TestCPUDiverInvalid(t *testing.T) {
+	diver := newTestCPUDiver(t, 1)
+	if _, err := diver.PoW(testTrytes[1:], 9); err == nil {
+		t.Error("PoW with short transaction")
+	}
+	if _, err := diver.PoW(testTrytes, -1); err == nil {
+		t.Error("PoW with negative mwm")
+	}
+}
@@ -0,0 +1,162 @@
+package pidiver
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iotaledger/iota.go/curl"
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// software Curl-P81 used by the emulated devices and the cpu backend
+
+const (
+	// offset of the nonce in the last block (and in the state)
+	NONCE_OFFSET = HASH_LENGTH - NONCE_TRINARY_SIZE
+
+	// number of lanes of the bit-sliced search
+	LANES = 64
+)
+
+// bit-sliced state: every bit is one lane, trits are encoded like on the FPGA
+// 0 -> hi=1 lo=1, 1 -> hi=1 lo=0, -1 -> hi=0 lo=1
+type state64 struct {
+	lo [STATE_LENGTH]uint64
+	hi [STATE_LENGTH]uint64
+}
+
+// fills the nonce trits of the lanes of a batch and returns the lanes which are used
+type laneFiller func(batch uint64, lo *[NONCE_TRINARY_SIZE]uint64, hi *[NONCE_TRINARY_SIZE]uint64) uint64
+
+// do one Curl-P81 transform on trits
+func curlTransform(state trinary.Trits) {
+	c := curl.Curl{State: state}
+	c.Transform()
+}
+
+// absorb one block of 243 trits into the state
+func curlAbsorb(state trinary.Trits, block trinary.Trits, doCurl bool) {
+	copy(state[0:HASH_LENGTH], block)
+	if doCurl {
+		curlTransform(state)
+	}
+}
+
+// set trit of a lane in bit-sliced representation
+func setLaneTrit(lo *uint64, hi *uint64, lane uint, trit int8) {
+	h, l := tritToBits(trit)
+	*lo = (*lo &^ (1 << lane)) | uint64(l)<<lane
+	*hi = (*hi &^ (1 << lane)) | uint64(h)<<lane
+}
+
+func (s *state64) load(trits trinary.Trits) {
+	for i := 0; i < STATE_LENGTH; i++ {
+		h, l := tritToBits(trits[i])
+		s.lo[i] = -uint64(l)
+		s.hi[i] = -uint64(h)
+	}
+}
+
+func (s *state64) transform() {
+	var tmp state64
+	from := s
+	to := &tmp
+
+	for r := 0; r < curl.NumberOfRounds; r++ {
+		for j := 0; j < STATE_LENGTH; j++ {
+			t1 := curl.Indices[j]
+			t2 := curl.Indices[j+1]
+
+			alpha := from.lo[t1]
+			beta := from.hi[t1]
+			gamma := from.hi[t2]
+			delta := (alpha | (^gamma)) & (from.lo[t2] ^ beta)
+
+			to.lo[j] = ^delta
+			to.hi[j] = (alpha ^ gamma) | delta
+		}
+		from, to = to, from
+	}
+	// odd number of rounds - result is in tmp
+	if from != s {
+		*s = *from
+	}
+}
+
+// lanes whose hash ends with mwm zero trits
+func (s *state64) check(mwm int) uint64 {
+	probe := ^uint64(0)
+	for i := HASH_LENGTH - mwm; i < HASH_LENGTH; i++ {
+		probe &= s.lo[i] & s.hi[i]
+		if probe == 0 {
+			return 0
+		}
+	}
+	return probe
+}
+
+// search a nonce on the midstate. Batches are handed out to workers goroutines in
+// increasing order until a lane was found, maxBatch is reached or stop is closed.
+// Returns the batch and the lanes which found a nonce.
+func searchNonce(mid trinary.Trits, mwm int, workers int, maxBatch uint64, fill laneFiller, stop <-chan struct{}) (uint64, uint64, bool) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var base state64
+	base.load(mid)
+
+	var (
+		next  uint64
+		done  int32
+		lock  sync.Mutex
+		found bool
+		batch uint64
+		lanes uint64
+		wg    sync.WaitGroup
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s state64
+			var nonceLo, nonceHi [NONCE_TRINARY_SIZE]uint64
+			for atomic.LoadInt32(&done) == 0 {
+				select {
+				case <-stop:
+					atomic.StoreInt32(&done, 1)
+					return
+				default:
+				}
+
+				b := atomic.AddUint64(&next, 1) - 1
+				if b >= maxBatch {
+					return
+				}
+
+				copy(nonceLo[:], base.lo[NONCE_OFFSET:HASH_LENGTH])
+				copy(nonceHi[:], base.hi[NONCE_OFFSET:HASH_LENGTH])
+				used := fill(b, &nonceLo, &nonceHi)
+
+				s = base
+				copy(s.lo[NONCE_OFFSET:HASH_LENGTH], nonceLo[:])
+				copy(s.hi[NONCE_OFFSET:HASH_LENGTH], nonceHi[:])
+				s.transform()
+
+				if hit := s.check(mwm) & used; hit != 0 {
+					lock.Lock()
+					if !found || b < batch {
+						found, batch, lanes = true, b, hit
+					}
+					lock.Unlock()
+					atomic.StoreInt32(&done, 1)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return batch, lanes, found
+}
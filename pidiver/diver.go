@@ -0,0 +1,130 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/iotaledger/iota.go/trinary"
+	"github.com/shufps/pidiver/bitstream"
+)
+
+// Diver is implemented by every PoW backend (PiDiver, USBDiver, PoWChipDiver, ...)
+type Diver interface {
+	// initialize the device (configure fpga, read versions, ...)
+	Init() error
+	// do PoW - compatible with pow.ProofOfWorkFunc
+	PoW(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error)
+	// do PoW until the nonce is found or ctx is done (returns ErrCancelled then)
+	PoWContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error)
+	// version and capabilities of the device
+	Info() DiverInfo
+	// release the device
+	Close() error
+}
+
+// ErrCancelled is returned by PoWContext when the context was cancelled or its deadline exceeded
+var ErrCancelled = errors.New("pow cancelled")
+
+// DiverInfo describes a backend after initialization
+type DiverInfo struct {
+	Type     string // registered type name
+	Device   string // device file (if any)
+	Version  string // firmware or fpga core version
+	Parallel uint32 // number of parallel PoW units (0 if unknown)
+	UseCRC   bool
+	Shared   bool // pidiver/usbdiver sharing lock
+
+	Core       string // core file of the config (or in the flash of usbdivers)
+	CoreSHA256 string // sha256 of the core (hex)
+}
+
+// core file and checksum for DiverInfo - read once on Init
+type coreInfo struct {
+	file   string
+	sha256 string
+}
+
+func readCoreInfo(filename string) coreInfo {
+	if filename == "" {
+		return coreInfo{}
+	}
+	info := coreInfo{file: filename}
+	if core, err := bitstream.Read(filename); err == nil {
+		info.sha256 = core.Checksum()
+	}
+	return info
+}
+
+// DiverFactory creates a (not yet initialized) backend from a config
+type DiverFactory func(config *PiDiverConfig) (Diver, error)
+
+var (
+	diversLock sync.RWMutex
+	divers     = make(map[string]DiverFactory)
+)
+
+func init() {
+	RegisterDiver("usbdiver", func(config *PiDiverConfig) (Diver, error) {
+		return &USBDiver{Config: config}, nil
+	})
+	RegisterDiver("powchip", func(config *PiDiverConfig) (Diver, error) {
+		return &PoWChipDiver{USBDiver: &USBDiver{Config: config}}, nil
+	})
+}
+
+// RegisterDiver makes a backend available by name. Backends which live in
+// their own package (e.g. raspberry) register themselves in init()
+func RegisterDiver(name string, factory DiverFactory) {
+	diversLock.Lock()
+	defer diversLock.Unlock()
+	if factory == nil {
+		panic("pidiver: RegisterDiver factory is nil")
+	}
+	if _, dup := divers[name]; dup {
+		panic("pidiver: RegisterDiver called twice for " + name)
+	}
+	divers[name] = factory
+}
+
+// DiverTypes returns the sorted names of all registered backends
+func DiverTypes() []string {
+	diversLock.RLock()
+	defer diversLock.RUnlock()
+	var names []string
+	for name := range divers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDiver creates the backend registered as name. The returned Diver still has to be initialized
+func NewDiver(name string, config *PiDiverConfig) (Diver, error) {
+	diversLock.RLock()
+	factory, ok := divers[name]
+	diversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s (available: %v)", name, DiverTypes())
+	}
+	if config == nil {
+		return nil, errors.New("no config given")
+	}
+	config.Type = name
+	return factory(config)
+}
+
+// OpenDiver creates and initializes the backend registered as name
+func OpenDiver(name string, config *PiDiverConfig) (Diver, error) {
+	diver, err := NewDiver(name, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := diver.Init(); err != nil {
+		diver.Close()
+		return nil, err
+	}
+	return diver, nil
+}
@@ -0,0 +1,275 @@
+package pidiver
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// software emulation of the PiDiver FPGA register protocol. Can be used as
+// LLStruct of a PiDiver on machines without hardware (type "emulator")
+
+const (
+	EMULATOR_PARALLEL      = 8
+	EMULATOR_VERSION_MAJOR = 1
+	EMULATOR_VERSION_MINOR = 1
+)
+
+func init() {
+	RegisterDiver("emulator", func(config *PiDiverConfig) (Diver, error) {
+		return &PiDiver{LLStruct: NewEmulator(EMULATOR_PARALLEL).LowLevel(), Config: config}, nil
+	})
+}
+
+type Emulator struct {
+	Parallel     uint32
+	VersionMajor uint32
+	VersionMinor uint32
+	Workers      int // goroutines used for nonce search (0: number of cpus)
+
+	lock        sync.Mutex
+	configured  bool
+	wrptr       int
+	data        [HASH_LENGTH / DATA_WIDTH]uint32
+	state       trinary.Trits
+	mwm         int
+	flags       uint32
+	nonce       uint32
+	mask        uint32
+	reservation uint32
+	stop        chan struct{}
+}
+
+func NewEmulator(parallel uint32) *Emulator {
+	return &Emulator{
+		Parallel:     parallel,
+		VersionMajor: EMULATOR_VERSION_MAJOR,
+		VersionMinor: EMULATOR_VERSION_MINOR,
+		state:        make(trinary.Trits, STATE_LENGTH),
+	}
+}
+
+func (e *Emulator) LowLevel() LLStruct {
+	return LLStruct{LLInit: e.llInit, LLSPISend: e.send, LLSPISendBlock: e.sendBlock, LLSPISendReceive: e.sendReceive, LLClose: e.llClose}
+}
+
+func (e *Emulator) llInit(config *PiDiverConfig) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.configured = true
+	return nil
+}
+
+func (e *Emulator) llClose() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.stopSearch()
+	e.configured = false
+	return nil
+}
+
+func (e *Emulator) send(cmd uint32) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.execute(cmd)
+	return nil
+}
+
+func (e *Emulator) sendBlock(data []uint32) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, cmd := range data {
+		e.execute(cmd)
+	}
+	return nil
+}
+
+func (e *Emulator) sendReceive(cmd uint32) (uint32, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.configured {
+		return 0, nil
+	}
+	switch cmd {
+	case CMD_READ_FLAGS:
+		return e.flags |
+			(e.Parallel&0xf)<<4 |
+			(e.mask&0xff)<<8 |
+			e.reservation<<FLAG_RESERVATION_READ_SHIFT |
+			(e.VersionMinor&0xf)<<24 |
+			(e.VersionMajor&0xf)<<28, nil
+	case CMD_READ_NONCE:
+		return e.nonce, nil
+	case CMD_READ_CRC32:
+		return e.crc32(), nil
+	}
+	e.execute(cmd)
+	return 0, nil
+}
+
+func (e *Emulator) execute(cmd uint32) {
+	if !e.configured {
+		return
+	}
+	switch cmd & 0xfc000000 {
+	case CMD_RESET_WRPTR:
+		e.wrptr = 0
+	case CMD_WRITE_DATA:
+		if e.wrptr < len(e.data) {
+			e.data[e.wrptr] = cmd
+			e.wrptr++
+		}
+	case CMD_WRITE_MIN_WEIGHT_MAGNITUDE:
+		e.mwm = 0
+		for bits := cmd & 0x03ffffff; bits != 0; bits >>= 1 {
+			e.mwm += int(bits & 0x1)
+		}
+	case CMD_WRITE_FLAGS:
+		e.writeFlags(cmd)
+	}
+}
+
+func (e *Emulator) writeFlags(cmd uint32) {
+	if cmd&FLAG_RESERVATION_RESET != 0 {
+		e.reservation = 0
+	}
+	if res := (cmd & FLAG_RESERVATION_WRITE) >> FLAG_RESERVATION_WRITE_SHIFT; res != 0 && e.reservation == 0 {
+		e.reservation = res
+	}
+	if cmd&FLAG_CURL_RESET != 0 {
+		e.stopSearch()
+		for i := range e.state {
+			e.state[i] = 0
+		}
+		e.flags = 0
+		e.mask = 0
+	}
+	if cmd&FLAG_CURL_WRITE != 0 {
+		curlAbsorb(e.state, e.blockTrits(), cmd&FLAG_CURL_DO_CURL != 0)
+		e.flags |= FLAG_CURL_FINISHED
+	}
+	if cmd&FLAG_START != 0 {
+		e.startSearch()
+	}
+}
+
+// trits of the received data words
+func (e *Emulator) blockTrits() trinary.Trits {
+	trits := make(trinary.Trits, HASH_LENGTH)
+	for i, word := range e.data {
+		for j := uint32(0); j < DATA_WIDTH; j++ {
+			lo := uint8((word >> j) & 0x1)
+			hi := uint8((word >> (j + DATA_WIDTH)) & 0x1)
+			trits[i*DATA_WIDTH+int(j)] = bitsToTrits(hi, lo)
+		}
+	}
+	return trits
+}
+
+// crc32 over data words and write addresses like calculated by the FPGA
+func (e *Emulator) crc32() uint32 {
+	bytes := make([]byte, len(e.data)*4)
+	for i, word := range e.data {
+		verify := (swapBytes(word) & 0xffff0300) | (uint32(i)&0x3f)<<10 | (uint32(i)&0xc0)>>6
+		binary.LittleEndian.PutUint32(bytes[i*4:], verify)
+	}
+	return crc(bytes, len(bytes))
+}
+
+func (e *Emulator) stopSearch() {
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+}
+
+func (e *Emulator) startSearch() {
+	e.stopSearch()
+	stop := make(chan struct{})
+	e.stop = stop
+	e.flags = FLAG_RUNNING | (e.flags & FLAG_CURL_FINISHED)
+	e.mask = 0
+	e.nonce = 0
+
+	mid := make(trinary.Trits, STATE_LENGTH)
+	copy(mid, e.state)
+	go e.search(mid, e.mwm, stop)
+}
+
+func (e *Emulator) search(mid trinary.Trits, mwm int, stop chan struct{}) {
+	parallel := e.Parallel
+	if parallel == 0 || parallel > 8 {
+		parallel = 1
+	}
+	counters := uint64(LANES / parallel) // nonce counters per batch
+	fill, err := pidiverLaneFiller(parallel, counters)
+	if err != nil {
+		return
+	}
+	// -2 because the FPGA reports the nonce counter two steps ahead
+	maxBatch := (uint64(0xffffffff) - 2) / counters
+
+	batch, lanes, found := searchNonce(mid, mwm, e.Workers, maxBatch, fill, stop)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.stop != stop {
+		// aborted
+		return
+	}
+	e.stop = nil
+	e.flags &= ^FLAG_RUNNING
+	if !found {
+		e.flags |= FLAG_OVERFLOW
+		return
+	}
+
+	k, mask := firstHit(lanes, parallel)
+	e.mask = mask
+	e.nonce = uint32(batch*counters+k) + 2
+	e.flags |= FLAG_FOUND
+}
+
+// first counter of a batch with a hit - mask are all units which found a nonce with it
+func firstHit(lanes uint64, parallel uint32) (uint64, uint32) {
+	var first uint
+	for lanes&(1<<first) == 0 {
+		first++
+	}
+	k := uint64(first) / uint64(parallel)
+	return k, uint32((lanes >> (k * uint64(parallel))) & ((1 << parallel) - 1))
+}
+
+// lanes of a batch: lane = counter*parallel + unit with the nonce layout of assembleNonce
+func pidiverLaneFiller(parallel uint32, counters uint64) (laneFiller, error) {
+	// precalculate the trits which only depend on the unit
+	units := make([]trinary.Trits, parallel)
+	for unit := uint32(0); unit < parallel; unit++ {
+		trits, err := assembleNonceTrits(0, 1<<unit, parallel)
+		if err != nil {
+			return nil, err
+		}
+		units[unit] = trits
+	}
+
+	return func(batch uint64, lo *[NONCE_TRINARY_SIZE]uint64, hi *[NONCE_TRINARY_SIZE]uint64) uint64 {
+		var used uint64
+		for k := uint64(0); k < counters; k++ {
+			counter := uint32(batch*counters + k)
+			for unit := uint32(0); unit < parallel; unit++ {
+				lane := uint(k*uint64(parallel) + uint64(unit))
+				trits := units[unit]
+				for i := 0; i < NONCE_TRINARY_SIZE-32; i++ {
+					setLaneTrit(&lo[i], &hi[i], lane, trits[i])
+				}
+				for i := 0; i < 32; i++ {
+					setLaneTrit(&lo[NONCE_TRINARY_SIZE-32+i], &hi[NONCE_TRINARY_SIZE-32+i], lane,
+						bitsToTrits(uint8((^counter>>uint32(i))&0x1), uint8((counter>>uint32(i))&0x1)))
+				}
+				used |= 1 << lane
+			}
+		}
+		return used
+	}, nil
+}
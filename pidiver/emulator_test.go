@@ -0,0 +1,114 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotaledger/iota.go/curl"
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+var testTrytes = strings.Repeat("9", 2673)
+
+func checkNonce(t *testing.T, trytes string, nonce trinary.Trytes, mwm int) {
+	t.Helper()
+	hash := curl.HashTrytes(trytes[:len(trytes)-len(nonce)] + nonce)
+	if zeros := trinary.TrailingZeros(trinary.MustTrytesToTrits(hash)); zeros < int64(mwm) {
+		t.Errorf("nonce %s has %d trailing zeros (mwm %d)", nonce, zeros, mwm)
+	}
+}
+
+// PoW which is cancelled after a short time - it must not find a nonce
+func checkCancel(t *testing.T, diver Diver) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if nonce, err := diver.PoWContext(ctx, testTrytes, 40); !errors.Is(err, ErrCancelled) {
+		t.Errorf("PoW not cancelled: %s, %v", nonce, err)
+	}
+}
+
+func newTestEmulator(t *testing.T) *PiDiver {
+	return newTestEmulatorLL(t, NewEmulator(EMULATOR_PARALLEL).LowLevel(), false)
+}
+
+func newTestEmulatorLL(t *testing.T, ll LLStruct, useCRC bool) *PiDiver {
+	diver := &PiDiver{LLStruct: ll, Config: &PiDiverConfig{Type: "emulator", UseCRC: useCRC}}
+	if err := diver.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diver.Close() })
+	return diver
+}
+
+func TestEmulatorPoW(t *testing.T) {
+	diver := newTestEmulator(t)
+	for _, mwm := range []int{1, 9, 12} {
+		nonce, err := diver.PoW(testTrytes, mwm)
+		if err != nil {
+			t.Fatalf("mwm %d: %v", mwm, err)
+		}
+		checkNonce(t, testTrytes, nonce, mwm)
+	}
+}
+
+func TestEmulatorCancel(t *testing.T) {
+	diver := newTestEmulator(t)
+	checkCancel(t, diver)
+
+	// the emulator searches again after a cancel
+	nonce, err := diver.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+}
+
+func TestEmulatorCRC(t *testing.T) {
+	diver := newTestEmulatorLL(t, NewEmulator(EMULATOR_PARALLEL).LowLevel(), true)
+	for _, mwm := range []int{1, 9} {
+		nonce, err := diver.PoW(testTrytes, mwm)
+		if err != nil {
+			t.Fatalf("mwm %d: %v", mwm, err)
+		}
+		checkNonce(t, testTrytes, nonce, mwm)
+	}
+	if stats := diver.Stats(); stats != (PiDiverStats{}) {
+		t.Errorf("stats %+v without transmission errors", stats)
+	}
+}
+
+// flips a bit of the first data word of the next blocks on the way to the emulator
+type noisyLL struct {
+	LLStruct
+	corrupt int
+}
+
+func (n *noisyLL) sendBlock(data []uint32) error {
+	if n.corrupt > 0 {
+		n.corrupt--
+		data = append([]uint32(nil), data...)
+		data[0] ^= 0x1
+	}
+	return n.LLStruct.LLSPISendBlock(data)
+}
+
+func TestEmulatorCRCErrors(t *testing.T) {
+	noisy := &noisyLL{LLStruct: NewEmulator(EMULATOR_PARALLEL).LowLevel(), corrupt: 2}
+	ll := noisy.LLStruct
+	ll.LLSPISendBlock = noisy.sendBlock
+	diver := newTestEmulatorLL(t, ll, true)
+
+	// the emulator computes the CRC32 over the corrupted data - both blocks are sent again
+	nonce, err := diver.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+	if stats := diver.Stats(); stats.CRCErrors != 2 || stats.Retries != 2 {
+		t.Errorf("stats %+v, expected 2 crc errors and retries", stats)
+	}
+}
@@ -0,0 +1,55 @@
+package pidiver
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors of the device layer. They are wrapped with details (and DeviceError)
+// and can be checked with errors.Is:
+//
+//	if errors.Is(err, pidiver.ErrDeviceGone) { ... reopen ... }
+var (
+	ErrProtocol      = errors.New("protocol error")
+	ErrCRC           = errors.New("crc error")
+	ErrTimeout       = errors.New("timeout")
+	ErrNotConfigured = errors.New("fpga not configured")
+	ErrReservation   = errors.New("couldn't get device reservation")
+	ErrDeviceGone    = errors.New("device gone")
+)
+
+// DeviceError is returned by the initialization of a device
+type DeviceError struct {
+	Device string // Config.Device
+	Op     string // e.g. "open", "configure"
+	Err    error
+}
+
+func (e *DeviceError) Error() string {
+	if e.Device == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Device, e.Err)
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+// TransmissionError is returned when the recovery of transmission errors gave up.
+// It is ErrTransmission and wraps the last error (e.g. ErrCRC)
+type TransmissionError struct {
+	Err error
+}
+
+func (e *TransmissionError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTransmission, e.Err)
+}
+
+func (e *TransmissionError) Is(target error) bool {
+	return target == ErrTransmission
+}
+
+func (e *TransmissionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,405 @@
+package pidiver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/lunixbochs/struc"
+	"github.com/shufps/pidiver/bitstream"
+)
+
+// core management of the spi flash of USBDivers since version 1.1. The core is
+// written to the first pages, the last page (FLASH_META_PAGE) describes it.
+
+const (
+	META_VERSION = 1
+)
+
+var (
+	ErrFlashEmpty    = errors.New("flash is empty")
+	ErrMetaChecksum  = errors.New("meta page checksum error")
+	ErrFlashMismatch = errors.New("flash doesn't match core")
+)
+
+type FlashState int
+
+const (
+	FlashEmpty    FlashState = iota
+	FlashInvalid             // meta page is corrupted
+	FlashOutdated            // other core (meta pages without checksum: other name or size)
+	FlashCurrent
+)
+
+func (s FlashState) String() string {
+	switch s {
+	case FlashEmpty:
+		return "empty"
+	case FlashInvalid:
+		return "invalid"
+	case FlashOutdated:
+		return "outdated"
+	case FlashCurrent:
+		return "current"
+	}
+	return "unknown"
+}
+
+func (m *Meta) IsEmpty() bool {
+	return m.Timestamp == 0xffffffffffffffff || m.Filesize == 0 || m.Filesize == 0xffffffff
+}
+
+// meta page has version, sha256 and checksum
+func (m *Meta) HasChecksum() bool {
+	return m.MetaVersion == META_VERSION
+}
+
+func (m *Meta) calcChecksum() (uint32, error) {
+	tmp := *m
+	tmp.Checksum = 0
+	var buf bytes.Buffer
+	if err := struc.Pack(&buf, &tmp); err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+	return crc(data, len(data)-4), nil
+}
+
+// set version and checksum
+func (m *Meta) Seal() error {
+	m.MetaVersion = META_VERSION
+	checksum, err := m.calcChecksum()
+	if err != nil {
+		return err
+	}
+	m.Checksum = checksum
+	return nil
+}
+
+func (m *Meta) Verify() error {
+	if m.IsEmpty() {
+		return ErrFlashEmpty
+	}
+	if !m.HasChecksum() {
+		return nil
+	}
+	checksum, err := m.calcChecksum()
+	if err != nil {
+		return err
+	}
+	if checksum != m.Checksum {
+		return ErrMetaChecksum
+	}
+	return nil
+}
+
+func (m *Meta) FilenameString() string {
+	var name []rune
+	for _, r := range m.Filename {
+		if r == 0 || r == 0xff {
+			break
+		}
+		name = append(name, r)
+	}
+	return string(name)
+}
+
+func (m *Meta) CoreVersionString() string {
+	return strings.TrimRight(string(m.CoreVersion[:]), "\x00\xff")
+}
+
+func (m *Meta) SHA256String() string {
+	if !m.HasChecksum() {
+		return ""
+	}
+	return hex.EncodeToString(m.SHA256[:])
+}
+
+func (m *Meta) String() string {
+	if m.IsEmpty() {
+		return "empty"
+	}
+	return fmt.Sprintf("file: %s, size: %d, version: %s, timestamp: %d, sha256: %s, meta version: %d",
+		m.FilenameString(), m.Filesize, m.CoreVersionString(), m.Timestamp, m.SHA256String(), m.MetaVersion)
+}
+
+func newMeta(core *bitstream.Bitstream) (Meta, error) {
+	var meta Meta
+	meta.Timestamp = uint64(makeTimestamp())
+	copy(meta.Filename[0:31], []rune(filepath.Base(core.Filename)))
+	meta.Filesize = uint32(core.Size())
+	copy(meta.CoreVersion[:], core.Meta.Version)
+	meta.SHA256 = core.SHA256
+	err := meta.Seal()
+	return meta, err
+}
+
+func (u *USBDiver) FlashReadMeta() (Meta, error) {
+	return u.flashReadMeta()
+}
+
+// state of the flash compared to core (nil: only check the meta page)
+func (u *USBDiver) FlashState(core *bitstream.Bitstream) (FlashState, Meta, error) {
+	meta, err := u.flashReadMeta()
+	if err != nil {
+		return FlashInvalid, meta, err
+	}
+	if err := meta.Verify(); err == ErrFlashEmpty {
+		return FlashEmpty, meta, nil
+	} else if err != nil {
+		return FlashInvalid, meta, nil
+	}
+	if core == nil {
+		return FlashCurrent, meta, nil
+	}
+	if !meta.HasChecksum() {
+		if meta.matchesLegacy(core) {
+			return FlashCurrent, meta, nil
+		}
+		return FlashOutdated, meta, nil
+	}
+	if meta.SHA256 != core.SHA256 || meta.Filesize != uint32(core.Size()) {
+		return FlashOutdated, meta, nil
+	}
+	return FlashCurrent, meta, nil
+}
+
+// meta pages written before META_VERSION 1 only describe the core by its
+// filename (truncated to 31 characters) and size
+func (m *Meta) matchesLegacy(core *bitstream.Bitstream) bool {
+	name := []rune(filepath.Base(core.Filename))
+	if len(name) > 31 {
+		name = name[:31]
+	}
+	return filepath.Base(m.FilenameString()) == string(name) && m.Filesize == uint32(core.Size())
+}
+
+func (u *USBDiver) FlashErase() (err error) {
+	u.log(LevelInfo, "erasing flash ...")
+	p := u.progress(PhaseFlashErase, 0)
+	defer func() { p.Done(err) }()
+	return u.flashErase()
+}
+
+// erase flash, write core and meta page and verify it
+func (u *USBDiver) FlashWrite(filename string) error {
+	core, err := bitstream.Load(filename, "")
+	if err != nil {
+		return err
+	}
+	return u.flashWriteCore(core)
+}
+
+func (u *USBDiver) flashWriteCore(core *bitstream.Bitstream) error {
+	u.log(LevelInfo, "writing core", F("file", core.Filename), F("size", core.Size()), F("sha256", core.Checksum()))
+
+	// extend to page size
+	data := core.Padded(FLASH_SPI_PAGESIZE)
+	if len(data) > FLASH_META_PAGE*FLASH_SPI_PAGESIZE {
+		return ErrCoreTooBig
+	}
+
+	if err := u.FlashErase(); err != nil {
+		return err
+	}
+
+	if err := u.flashWritePages(data); err != nil {
+		return err
+	}
+
+	if err := u.flashVerifyData(data); err != nil {
+		return err
+	}
+	return u.flashCommitMeta(core)
+}
+
+func (u *USBDiver) flashWritePages(data []byte) (err error) {
+	u.log(LevelInfo, "flashing configuration ...")
+	p := u.progress(PhaseFlashWrite, int64(len(data)))
+	defer func() { p.Done(err) }()
+
+	numPages := uint32(len(data) / FLASH_SPI_PAGESIZE)
+	for page := uint32(0); page < numPages; page++ {
+		p.Update(int64(page * FLASH_SPI_PAGESIZE))
+		err := u.flashWritePageNumber(page, data[page*FLASH_SPI_PAGESIZE:(page+1)*FLASH_SPI_PAGESIZE])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write the meta page of core and read it back - only done after the core was verified
+func (u *USBDiver) flashCommitMeta(core *bitstream.Bitstream) (err error) {
+	meta, err := newMeta(core)
+	if err != nil {
+		return err
+	}
+
+	u.log(LevelInfo, "flashing meta-page ...")
+	p := u.progress(PhaseFlashMeta, FLASH_SPI_PAGESIZE)
+	defer func() { p.Done(err) }()
+
+	if err := u.flashWriteMeta(&meta); err != nil {
+		return err
+	}
+
+	verifyMeta, err := u.flashReadMeta()
+	if err != nil {
+		return err
+	}
+	if meta != verifyMeta {
+		return errors.New("meta verification failed")
+	}
+	return nil
+}
+
+// compare flash with data (padded to page size)
+func (u *USBDiver) flashVerifyData(data []byte) (err error) {
+	u.log(LevelInfo, "verifying configuration ...")
+	p := u.progress(PhaseFlashVerify, int64(len(data)))
+	defer func() { p.Done(err) }()
+
+	numPages := uint32(len(data) / FLASH_SPI_PAGESIZE)
+	for page := uint32(0); page < numPages; page++ {
+		p.Update(int64(page * FLASH_SPI_PAGESIZE))
+		read, err := u.flashReadPageNumber(page)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(read, data[page*FLASH_SPI_PAGESIZE:(page+1)*FLASH_SPI_PAGESIZE]) {
+			return fmt.Errorf("%w: verify error at page %d", ErrFlashMismatch, page)
+		}
+	}
+	return nil
+}
+
+// check meta page and the core in flash against its sha256 - and against the
+// core file if filename isn't empty
+func (u *USBDiver) FlashVerify(filename string) error {
+	var core *bitstream.Bitstream
+	if filename != "" {
+		var err error
+		if core, err = bitstream.Load(filename, ""); err != nil {
+			return err
+		}
+	}
+	state, meta, err := u.FlashState(core)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case FlashEmpty:
+		return ErrFlashEmpty
+	case FlashInvalid:
+		return ErrMetaChecksum
+	case FlashOutdated:
+		if core != nil {
+			return fmt.Errorf("%w: flash has %s", ErrFlashMismatch, meta.String())
+		}
+	}
+
+	if core != nil {
+		return u.flashVerifyData(core.Padded(FLASH_SPI_PAGESIZE))
+	}
+	if !meta.HasChecksum() {
+		return errors.New("meta page has no checksum - can't verify without core file")
+	}
+
+	var buf bytes.Buffer
+	if err := u.FlashDump(&buf, int(meta.Filesize)); err != nil {
+		return err
+	}
+	if sha256.Sum256(buf.Bytes()) != meta.SHA256 {
+		return fmt.Errorf("%w: sha256 of flash doesn't match meta page", ErrFlashMismatch)
+	}
+	return nil
+}
+
+// write size bytes of flash to w (0: size of the core in flash)
+func (u *USBDiver) FlashDump(w io.Writer, size int) (err error) {
+	if size <= 0 {
+		meta, err := u.flashReadMeta()
+		if err != nil {
+			return err
+		}
+		if err := meta.Verify(); err != nil {
+			return err
+		}
+		size = int(meta.Filesize)
+	}
+	if size > FLASH_SIZE {
+		size = FLASH_SIZE
+	}
+
+	p := u.progress(PhaseFlashRead, int64(size))
+	defer func() { p.Done(err) }()
+
+	numPages := uint32((size + FLASH_SPI_PAGESIZE - 1) / FLASH_SPI_PAGESIZE)
+	for page := uint32(0); page < numPages; page++ {
+		p.Update(int64(page * FLASH_SPI_PAGESIZE))
+		data, err := u.flashReadPageNumber(page)
+		if err != nil {
+			return err
+		}
+		if rest := size - int(page)*FLASH_SPI_PAGESIZE; rest < len(data) {
+			data = data[:rest]
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update flash with filename if the flash is empty, invalid or has another core. Only
+// pages which differ are written, so an interrupted update continues with the missing
+// pages. force erases and writes the whole core.
+func (u *USBDiver) FlashUpdate(filename string, force bool) error {
+	core, err := bitstream.Load(filename, "")
+	if err != nil {
+		// no core file - use what is in flash
+		state, meta, stateErr := u.FlashState(nil)
+		if stateErr != nil || state != FlashCurrent {
+			return err
+		}
+		u.log(LevelWarning, "using configuration in flash", F("error", err), F("meta", meta.String()))
+		return nil
+	}
+
+	state, meta, err := u.FlashState(core)
+	if err != nil {
+		return err
+	}
+	if !force && state == FlashCurrent {
+		u.log(LevelInfo, "configuration in flash found", F("meta", meta.String()))
+		return nil
+	}
+	if !force && state == FlashOutdated {
+		u.log(LevelWarning, "flash has another core - rewriting it", F("meta", meta.String()))
+	}
+	if force {
+		u.log(LevelInfo, "flashing is forced", F("state", state))
+		err = u.flashWriteCore(core)
+	} else {
+		u.log(LevelInfo, "updating flash", F("state", state))
+		err = u.flashUpdateCore(core)
+	}
+	if err != nil {
+		return err
+	}
+	u.log(LevelInfo, "flashing was successful!")
+	return nil
+}
+
+// configure the fpga with the core in flash
+func (u *USBDiver) ConfigureFromFlash() (err error) {
+	p := u.progress(PhaseConfigure, 0)
+	defer func() { p.Done(err) }()
+	return u.fpgaConfigure()
+}
@@ -0,0 +1,56 @@
+package pidiver
+
+import (
+	"testing"
+
+	"github.com/shufps/pidiver/bitstream"
+)
+
+// core pages with a meta page of the firmware tools before META_VERSION 1
+func newLegacyFlashTest(t *testing.T, name string, size int) (*USBDiver, *flashRecorder, string) {
+	u, port := newFlashTest(t)
+	data := testCoreData()
+	if err := u.flashWritePages((&bitstream.Bitstream{Data: data}).Padded(FLASH_SPI_PAGESIZE)); err != nil {
+		t.Fatal(err)
+	}
+	meta := Meta{Timestamp: 1, Filesize: uint32(size), AutoConf: 1}
+	copy(meta.Filename[0:31], []rune(name))
+	if err := u.flashWriteMeta(&meta); err != nil {
+		t.Fatal(err)
+	}
+	port.reset()
+	return u, port, writeTestCore(t, "core1.0.rbf", data)
+}
+
+func TestFlashStateLegacyMeta(t *testing.T) {
+	size := len(testCoreData())
+	for _, test := range []struct {
+		name  string
+		size  int
+		state FlashState
+	}{
+		{"core1.0.rbf", size, FlashCurrent},
+		{"../cores/core1.0.rbf", size, FlashCurrent},
+		{"core0.9.rbf", size, FlashOutdated},
+		{"core1.0.rbf", size - 1, FlashOutdated},
+	} {
+		u, port, filename := newLegacyFlashTest(t, test.name, test.size)
+		core, err := bitstream.Load(filename, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, meta, err := u.FlashState(core)
+		if err != nil || state != test.state {
+			t.Errorf("%s, %d bytes: state %v (%v), meta %s", test.name, test.size, state, err, meta.String())
+		}
+
+		// a matching core in flash is kept at boot
+		if err := u.FlashUpdate(filename, false); err != nil {
+			t.Fatal(err)
+		}
+		rewritten := port.erases > 0 || len(port.written) > 0
+		if rewritten != (test.state != FlashCurrent) {
+			t.Errorf("%s, %d bytes: rewritten %v", test.name, test.size, rewritten)
+		}
+	}
+}
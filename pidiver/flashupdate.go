@@ -0,0 +1,133 @@
+package pidiver
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/shufps/pidiver/bitstream"
+)
+
+// incremental update of the core in flash. The firmware can only erase the whole
+// chip and programming a page can only clear bits (NOR flash), so:
+//   - pages which already have the right content are skipped
+//   - pages which can be reached by clearing bits are programmed in place
+//   - everything else (or a meta page of another core) needs a chip erase
+//
+// The meta page is written after the whole core was verified, so an interrupted
+// update leaves an erased meta page behind. No progress is recorded - the next
+// update compares the pages again and only writes the ones which are missing.
+
+var ErrCoreTooBig = errors.New("core doesn't fit into flash")
+
+func isErased(data []uint8) bool {
+	for _, b := range data {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// page can be programmed without erasing
+func isProgrammable(flash []uint8, data []uint8) bool {
+	for i := range data {
+		if flash[i]&data[i] != data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// write only the pages of core which differ from flash
+func (u *USBDiver) flashUpdateCore(core *bitstream.Bitstream) error {
+	u.log(LevelInfo, "updating core", F("file", core.Filename), F("size", core.Size()), F("sha256", core.Checksum()))
+
+	data := core.Padded(FLASH_SPI_PAGESIZE)
+	if len(data) > FLASH_META_PAGE*FLASH_SPI_PAGESIZE {
+		return ErrCoreTooBig
+	}
+	numPages := uint32(len(data) / FLASH_SPI_PAGESIZE)
+
+	metaPage, err := u.flashReadPageNumber(FLASH_META_PAGE)
+	if err != nil {
+		return err
+	}
+
+	// the meta page of another core can only be replaced after erasing
+	var todo []bool
+	erase := !isErased(metaPage)
+	if !erase {
+		u.log(LevelInfo, "meta-page is erased - writing missing pages ...")
+		if todo, erase, err = u.flashComparePages(data); err != nil {
+			return err
+		}
+	}
+
+	if erase {
+		if err := u.FlashErase(); err != nil {
+			return err
+		}
+		todo = make([]bool, numPages)
+		for page := uint32(0); page < numPages; page++ {
+			todo[page] = !isErased(data[page*FLASH_SPI_PAGESIZE : (page+1)*FLASH_SPI_PAGESIZE])
+		}
+	}
+
+	if err := u.flashWriteChangedPages(data, todo); err != nil {
+		return err
+	}
+	if err := u.flashVerifyData(data); err != nil {
+		return err
+	}
+	return u.flashCommitMeta(core)
+}
+
+// read back pages and return the pages which differ. erase is set if a page
+// can't be programmed without erasing.
+func (u *USBDiver) flashComparePages(data []byte) (todo []bool, erase bool, err error) {
+	u.log(LevelInfo, "comparing flash ...")
+	p := u.progress(PhaseFlashCompare, int64(len(data)))
+	defer func() { p.Done(err) }()
+
+	numPages := uint32(len(data) / FLASH_SPI_PAGESIZE)
+	todo = make([]bool, numPages)
+	for page := uint32(0); page < numPages; page++ {
+		p.Update(int64(page * FLASH_SPI_PAGESIZE))
+		flash, err := u.flashReadPageNumber(page)
+		if err != nil {
+			return nil, false, err
+		}
+		pageData := data[page*FLASH_SPI_PAGESIZE : (page+1)*FLASH_SPI_PAGESIZE]
+		if bytes.Equal(flash, pageData) {
+			continue
+		}
+		if !isProgrammable(flash, pageData) {
+			u.log(LevelInfo, "page can't be programmed without erasing", F("page", page))
+			return nil, true, nil
+		}
+		todo[page] = true
+	}
+	return todo, false, nil
+}
+
+// program the todo pages
+func (u *USBDiver) flashWriteChangedPages(data []byte, todo []bool) (err error) {
+	u.log(LevelInfo, "flashing configuration ...")
+	p := u.progress(PhaseFlashWrite, int64(len(data)))
+	defer func() { p.Done(err) }()
+
+	numPages := uint32(len(data) / FLASH_SPI_PAGESIZE)
+	written := 0
+	for page := uint32(0); page < numPages; page++ {
+		p.Update(int64(page * FLASH_SPI_PAGESIZE))
+		if !todo[page] {
+			continue
+		}
+		if err := u.flashWritePageNumber(page, data[page*FLASH_SPI_PAGESIZE:(page+1)*FLASH_SPI_PAGESIZE]); err != nil {
+			return err
+		}
+		written++
+	}
+	u.log(LevelInfo, "pages written", F("written", written), F("pages", numPages))
+	return nil
+}
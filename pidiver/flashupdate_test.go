@@ -0,0 +1,221 @@
+package pidiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/shufps/pidiver/bitstream"
+)
+
+const TEST_CORE_PAGES = 64
+
+// port which records the flash commands sent to a virtual device
+type flashRecorder struct {
+	*VirtualUSBDevice
+	failPage int // the port breaks when this page is written (-1: never)
+
+	page    uint32
+	written map[uint32]int
+	erases  int
+}
+
+func newFlashRecorder() *flashRecorder {
+	return &flashRecorder{VirtualUSBDevice: NewVirtualUSBDevice(), failPage: -1, written: make(map[uint32]int)}
+}
+
+// every request is written at once
+func (r *flashRecorder) Write(data []byte) (int, error) {
+	switch data[1] {
+	case CMD_SET_PAGE:
+		r.page = binary.LittleEndian.Uint32(data[5:9])
+	case CMD_WRITE_PAGE:
+		if int(r.page) == r.failPage {
+			r.failPage = -1
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.written[r.page]++
+	case CMD_FLASH_ERASE:
+		r.erases++
+	}
+	return r.VirtualUSBDevice.Write(data)
+}
+
+func (r *flashRecorder) reset() {
+	r.written = make(map[uint32]int)
+	r.erases = 0
+}
+
+// core pages which were programmed
+func (r *flashRecorder) corePages() []uint32 {
+	var pages []uint32
+	for page := range r.written {
+		if page != FLASH_META_PAGE {
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return pages
+}
+
+func pageRange(first uint32, last uint32) []uint32 {
+	var pages []uint32
+	for page := first; page <= last; page++ {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+func checkPages(t *testing.T, written []uint32, expected []uint32) {
+	t.Helper()
+	if len(written) != len(expected) {
+		t.Errorf("written pages: %v, expected %v", written, expected)
+		return
+	}
+	for i := range written {
+		if written[i] != expected[i] {
+			t.Errorf("written pages: %v, expected %v", written, expected)
+			return
+		}
+	}
+}
+
+// small core with the header of a raw binary file
+func testCoreData() []byte {
+	data := make([]byte, TEST_CORE_PAGES*FLASH_SPI_PAGESIZE-100)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data, bytes.Repeat([]byte{0xff}, 32))
+	data[32] = bitstream.SYNC_BYTE
+	return data
+}
+
+func writeTestCore(t *testing.T, name string, data []byte) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func newFlashTest(t *testing.T) (*USBDiver, *flashRecorder) {
+	port := newFlashRecorder()
+	u := NewUSBDiverWithPort(&PiDiverConfig{Type: "usbdiver_virtual"}, port)
+	t.Cleanup(func() { u.Close() })
+	if err := u.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return u, port
+}
+
+// flash with the pages of the test core but without meta page (like an interrupted
+// update) and a core which differs from it
+func newFlashUpdateTest(t *testing.T, change func(data []byte)) (*USBDiver, *flashRecorder, string) {
+	u, port := newFlashTest(t)
+	data := testCoreData()
+	if err := u.flashWritePages((&bitstream.Bitstream{Data: data}).Padded(FLASH_SPI_PAGESIZE)); err != nil {
+		t.Fatal(err)
+	}
+	change(data)
+	port.reset()
+	return u, port, writeTestCore(t, "core1.1.rbf", data)
+}
+
+// offset of a byte in page which can be changed by clearing bits
+func programmableByte(t *testing.T, data []byte, page int) int {
+	for i := page * FLASH_SPI_PAGESIZE; i < (page+1)*FLASH_SPI_PAGESIZE; i++ {
+		if data[i] != 0 {
+			return i
+		}
+	}
+	t.Fatalf("page %d is zero", page)
+	return 0
+}
+
+func checkFlashCurrent(t *testing.T, u *USBDiver, filename string) {
+	t.Helper()
+	if err := u.FlashVerify(filename); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := u.FlashReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.Verify(); err != nil {
+		t.Fatalf("meta %v: %v", meta.String(), err)
+	}
+}
+
+func TestFlashUpdateWritesChangedPages(t *testing.T) {
+	u, port, filename := newFlashUpdateTest(t, func(data []byte) {
+		for _, page := range []int{10, 50} {
+			data[programmableByte(t, data, page)] = 0
+		}
+	})
+
+	if err := u.FlashUpdate(filename, false); err != nil {
+		t.Fatal(err)
+	}
+	if port.erases != 0 {
+		t.Errorf("%d chip erases", port.erases)
+	}
+	checkPages(t, port.corePages(), []uint32{10, 50})
+	checkFlashCurrent(t, u, filename)
+}
+
+func TestFlashUpdateErasesIfNotProgrammable(t *testing.T) {
+	u, port, filename := newFlashUpdateTest(t, func(data []byte) {
+		i := programmableByte(t, data, 10)
+		data[i] = ^data[i]
+	})
+
+	if err := u.FlashUpdate(filename, false); err != nil {
+		t.Fatal(err)
+	}
+	if port.erases != 1 {
+		t.Errorf("%d chip erases", port.erases)
+	}
+	checkPages(t, port.corePages(), pageRange(0, TEST_CORE_PAGES-1))
+	checkFlashCurrent(t, u, filename)
+}
+
+func TestFlashUpdateResumesInterruptedUpdate(t *testing.T) {
+	u, port := newFlashTest(t)
+	old := testCoreData()
+	if err := u.FlashWrite(writeTestCore(t, "core1.0.rbf", old)); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{}, old...)
+	i := programmableByte(t, data, 20)
+	data[i] = ^data[i]
+	filename := writeTestCore(t, "core1.1.rbf", data)
+
+	// the meta page of another core needs an erase - the port breaks while writing
+	port.reset()
+	port.failPage = 30
+	if err := u.FlashUpdate(filename, false); !errors.Is(err, ErrDeviceGone) {
+		t.Fatalf("update not interrupted: %v", err)
+	}
+	if port.erases != 1 {
+		t.Errorf("%d chip erases", port.erases)
+	}
+	if state, _, err := u.FlashState(nil); err != nil || state != FlashEmpty {
+		t.Errorf("state of interrupted update: %v, %v", state, err)
+	}
+
+	// the next update only writes the pages which are missing
+	port.reset()
+	if err := u.FlashUpdate(filename, false); err != nil {
+		t.Fatal(err)
+	}
+	if port.erases != 0 {
+		t.Errorf("%d chip erases", port.erases)
+	}
+	checkPages(t, port.corePages(), pageRange(30, TEST_CORE_PAGES-1))
+	checkFlashCurrent(t, u, filename)
+}
@@ -0,0 +1,131 @@
+package pidiver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// leveled logging with structured fields. The package is quiet by default -
+// programs set a logger with SetLogger (or per device in PiDiverConfig.Logger),
+// e.g. NewStdLogger for the log package.
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarning:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// message with fields as key=value
+func FormatMessage(msg string, fields []Field) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, field := range fields {
+		fmt.Fprintf(&b, " %s=%v", field.Key, field.Value)
+	}
+	return b.String()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(level Level, msg string, fields ...Field) {}
+
+// logger which discards everything
+var NopLogger Logger = nopLogger{}
+
+type stdLogger struct {
+	logger *log.Logger
+	level  Level
+}
+
+// adapter for the log package - messages below level are dropped (logger nil: standard logger)
+func NewStdLogger(logger *log.Logger, level Level) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogger{logger: logger, level: level}
+}
+
+func (l *stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.level {
+		return
+	}
+	l.logger.Printf("[%s] %s\n", level, FormatMessage(msg, fields))
+}
+
+var (
+	loggerLock    sync.RWMutex
+	defaultLogger = NopLogger
+)
+
+// logger of all devices without PiDiverConfig.Logger (nil: quiet)
+func SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NopLogger
+	}
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	defaultLogger = logger
+}
+
+func GetLogger() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return defaultLogger
+}
+
+// logger of a device - config.Logger or the one of SetLogger
+func ConfigLogger(config *PiDiverConfig) Logger {
+	if config != nil && config.Logger != nil {
+		return config.Logger
+	}
+	return GetLogger()
+}
+
+// logger which adds fields to every message
+func WithFields(logger Logger, fields ...Field) Logger {
+	return &fieldLogger{logger: logger, fields: fields}
+}
+
+type fieldLogger struct {
+	logger Logger
+	fields []Field
+}
+
+func (l *fieldLogger) Log(level Level, msg string, fields ...Field) {
+	l.logger.Log(level, msg, append(append([]Field{}, l.fields...), fields...)...)
+}
@@ -1,9 +1,9 @@
 package pidiver
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"time"
 	"unsafe"
 
@@ -15,12 +15,14 @@ type LLInitFunc func(config *PiDiverConfig) error
 type LLSPISendFunc func(data uint32) error
 type LLSPISendBlockFunc func(data []uint32) error
 type LLSPISendReceiveFunc func(cmd uint32) (uint32, error)
+type LLCloseFunc func() error
 
 type LLStruct struct {
 	LLInit           LLInitFunc
 	LLSPISend        LLSPISendFunc
 	LLSPISendReceive LLSPISendReceiveFunc
 	LLSPISendBlock   LLSPISendBlockFunc
+	LLClose          LLCloseFunc // optional
 }
 
 type PiDiver struct {
@@ -29,6 +31,8 @@ type PiDiver struct {
 	parallel     uint32
 	VersionMajor uint32
 	VersionMinor uint32
+	stats        retryStats
+	core         coreInfo
 }
 
 func (p *PiDiver) send(data uint32) error {
@@ -48,18 +52,22 @@ func (p *PiDiver) sendReceive(cmd uint32) (uint32, error) {
 func (p *PiDiver) InitPiDiver() error {
 	err := p.LLStruct.LLInit(p.Config)
 	if err != nil {
-		return err
+		return &DeviceError{Device: p.Config.Device, Op: "init", Err: err}
 	}
 
 	p.VersionMajor, p.VersionMinor, err = p.readFPGAVersion()
-	log.Printf("FPGA version: %d.%d\n", p.VersionMajor, p.VersionMinor)
+	if err != nil {
+		return &DeviceError{Device: p.Config.Device, Op: "init", Err: err}
+	}
+	p.log(LevelInfo, "FPGA version", F("version", p.GetCoreVersion()))
 
 	p.parallel, err = p.readParallelLevel()
 	if err != nil {
-		return err
+		return &DeviceError{Device: p.Config.Device, Op: "init", Err: err}
 	}
-	log.Printf("Parallel Level Detected: %d\n", p.parallel)
+	p.log(LevelInfo, "parallel level detected", F("parallel", p.parallel))
 
+	p.core = readCoreInfo(p.Config.ConfigFile)
 	initTryteMap()
 	return nil
 }
@@ -68,6 +76,40 @@ func (p *PiDiver) GetCoreVersion() string {
 	return fmt.Sprintf("%v.%v", p.VersionMajor, p.VersionMinor)
 }
 
+// Diver interface
+func (p *PiDiver) Init() error {
+	return p.InitPiDiver()
+}
+
+func (p *PiDiver) PoW(trytes Trytes, minWeight int, parallelism ...int) (Trytes, error) {
+	return p.PowPiDiver(trytes, minWeight, parallelism...)
+}
+
+func (p *PiDiver) PoWContext(ctx context.Context, trytes Trytes, minWeight int) (Trytes, error) {
+	return p.PowPiDiverContext(ctx, trytes, minWeight)
+}
+
+func (p *PiDiver) Info() DiverInfo {
+	return DiverInfo{
+		Type:     p.Config.Type,
+		Device:   p.Config.Device,
+		Version:  p.GetCoreVersion(),
+		Parallel: p.parallel,
+		UseCRC:   p.Config.UseCRC,
+		Shared:   p.Config.UseSharedLock,
+
+		Core:       p.core.file,
+		CoreSHA256: p.core.sha256,
+	}
+}
+
+func (p *PiDiver) Close() error {
+	if p.LLStruct.LLClose == nil {
+		return nil
+	}
+	return p.LLStruct.LLClose()
+}
+
 // start PoW
 func (p *PiDiver) startPow() error {
 	return p.send(CMD_WRITE_FLAGS | FLAG_START)
@@ -104,11 +146,11 @@ func (p *PiDiver) readCRC32() (uint32, error) {
 	return p.sendReceive(CMD_READ_CRC32)
 }
 
-func (p *PiDiver) writeMinWeightMagnitude(bits uint32) {
+func (p *PiDiver) writeMinWeightMagnitude(bits uint32) error {
 	if bits > 26 {
 		bits = 26
 	}
-	p.send(CMD_WRITE_MIN_WEIGHT_MAGNITUDE | ((1 << bits) - 1))
+	return p.send(CMD_WRITE_MIN_WEIGHT_MAGNITUDE | ((1 << bits) - 1))
 }
 
 // get Mask
@@ -134,7 +176,7 @@ func (p *PiDiver) readFPGAVersion() (uint32, uint32, error) {
 	return major, minor, err
 }
 
-func (p *PiDiver) waitForReservation(timeout time.Duration) error {
+func (p *PiDiver) waitForReservation(ctx context.Context, timeout time.Duration) error {
 	start := time.Now()
 	for {
 		// make reservation
@@ -153,134 +195,304 @@ func (p *PiDiver) waitForReservation(timeout time.Duration) error {
 		}
 		// no wait and try again
 		if time.Since(start) > timeout {
-			return errors.New("couldn't get device reservation")
+			return fmt.Errorf("%w after %v", ErrReservation, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ErrCancelled
+		case <-time.After(50 * time.Millisecond):
 		}
-		time.Sleep(50 * time.Millisecond)
 	}
 }
 
-// send trytes for midstate calculation and check for transmission errors
-func (p *PiDiver) sendTritData(trytes string) error {
+// send trytes for midstate calculation and check for transmission errors. The
+// block is sent again until the retries of the policy are used up
+func (p *PiDiver) sendTritData(ctx context.Context, trytes string) error {
+	policy := p.retryPolicy()
 	uint32Data := make([]uint32, HASH_LENGTH/DATA_WIDTH)
 	verifyData := make([]uint32, HASH_LENGTH/DATA_WIDTH)
-	for tries := 1; ; tries++ {
-		for i := 0; i < HASH_LENGTH/DATA_WIDTH; i++ {
-			key := trytes[i*3 : i*3+3]
-			uint32Data[i] = tryteMap[key]
-			verifyData[i] = (swapBytes(uint32Data[i]) & 0xffff0300) | (uint32(i)&0x3f)<<10 | (uint32(i)&0xc0)>>6
+	for i := 0; i < HASH_LENGTH/DATA_WIDTH; i++ {
+		key := trytes[i*3 : i*3+3]
+		uint32Data[i] = tryteMap[key]
+		verifyData[i] = (swapBytes(uint32Data[i]) & 0xffff0300) | (uint32(i)&0x3f)<<10 | (uint32(i)&0xc0)>>6
+	}
+
+	for tries := 0; ; tries++ {
+		err := p.transmitTritData(uint32Data, verifyData)
+		if err == nil {
+			return nil
+		}
+		if tries >= policy.BlockRetries {
+			return err
 		}
-		p.resetWritePointer()
-		p.sendBlock(uint32Data)
+		p.stats.add(func(s *PiDiverStats) { s.Retries++ })
+		if err := backoff(ctx, policy, tries); err != nil {
+			return err
+		}
+	}
+}
+
+// send data words of one block and verify them with the CRC32 of the FPGA
+func (p *PiDiver) transmitTritData(uint32Data []uint32, verifyData []uint32) error {
+	if err := p.resetWritePointer(); err != nil {
+		p.stats.add(func(s *PiDiverStats) { s.TransportErrors++ })
+		return err
+	}
+	if err := p.sendBlock(uint32Data); err != nil {
+		p.stats.add(func(s *PiDiverStats) { s.TransportErrors++ })
+		return err
+	}
+	if !p.Config.UseCRC {
+		return nil
+	}
 
-		if p.Config.UseCRC {
-			verifyBytes := *(*[HASH_LENGTH / DATA_WIDTH * 4]byte)(unsafe.Pointer(&verifyData[0]))
+	verifyBytes := *(*[HASH_LENGTH / DATA_WIDTH * 4]byte)(unsafe.Pointer(&verifyData[0]))
 
-			crc32Verify := crc(verifyBytes[:], len(verifyBytes))
-			crc32, err := p.readCRC32()
-			if err != nil {
-				return err
-			}
-			//		log.Printf("CRC32: %08x\n", crc32)
-			//		log.Printf("CRC32 Verify: %08x\n", crc32Verify)
-
-			if crc32Verify != crc32 {
-				return errors.New("CRC error")
-				/*				log.Printf("Transfer Error (%d/10).\n", tries)
-								if tries == 11 {
-									return errors.New("CRC32 error - giving up ...")
-								}
-								continue*/
-			} else {
-				break
-			}
-		} else {
-			break
-		}
+	crc32Verify := crc(verifyBytes[:], len(verifyBytes))
+	crc32, err := p.readCRC32()
+	if err != nil {
+		p.stats.add(func(s *PiDiverStats) { s.TransportErrors++ })
+		return err
+	}
+
+	if crc32Verify != crc32 {
+		p.stats.add(func(s *PiDiverStats) { s.CRCErrors++ })
+		return fmt.Errorf("%w: block %08x, fpga %08x", ErrCRC, crc32Verify, crc32)
 	}
 	return nil
 }
 
 // send block for midstate calculation
-func (p *PiDiver) curlSendBlock(trytes string, doCurl bool) error {
-	if err := p.sendTritData(trytes); err != nil {
+func (p *PiDiver) curlSendBlock(ctx context.Context, trytes string, doCurl bool) error {
+	if err := p.sendTritData(ctx, trytes); err != nil {
 		return err
 	}
 	cmd := CMD_WRITE_FLAGS | FLAG_CURL_WRITE
 	if doCurl {
 		cmd |= FLAG_CURL_DO_CURL
 	}
-	p.send(cmd)
+	if err := p.send(cmd); err != nil {
+		p.stats.add(func(s *PiDiverStats) { s.TransportErrors++ })
+		return err
+	}
 
 	// instantly read back ... curl needs <1µs on fpga and spi is slower
 	flags, err := p.getFlags()
-	if flags&FLAG_CURL_FINISHED == 0 || err != nil {
-		return errors.New("Curl didn't finish")
+	if err != nil {
+		p.stats.add(func(s *PiDiverStats) { s.TransportErrors++ })
+		return err
+	}
+	if flags&FLAG_CURL_FINISHED == 0 {
+		return fmt.Errorf("%w: curl didn't finish", ErrTimeout)
+	}
+	return nil
+}
+
+// do mid-state-calculation on FPGA
+func (p *PiDiver) sendMidstate(ctx context.Context, trytes Trytes) error {
+	if err := p.curlInitBlock(); err != nil {
+		p.stats.add(func(s *PiDiverStats) { s.TransportErrors++ })
+		return err
+	}
+	for blocknr := 0; blocknr < 33; blocknr++ {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		doCurl := true
+		if blocknr == 32 {
+			doCurl = false
+		}
+		if err := p.curlSendBlock(ctx, string(trytes)[blocknr*(HASH_LENGTH/3):(blocknr+1)*(HASH_LENGTH/3)], doCurl); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// mid-state-calculation - if a block keeps failing the curl state is reset and
+// all blocks are sent again
+func (p *PiDiver) uploadMidstate(ctx context.Context, trytes Trytes) error {
+	policy := p.retryPolicy()
+	for resync := 0; ; resync++ {
+		err := p.sendMidstate(ctx, trytes)
+		if err == nil || errors.Is(err, ErrCancelled) {
+			return err
+		}
+		if resync >= policy.Resyncs {
+			return err
+		}
+		p.stats.add(func(s *PiDiverStats) { s.Resyncs++ })
+		p.log(LevelWarning, "midstate upload failed - resync", F("error", err), F("resync", resync+1), F("resyncs", policy.Resyncs))
+		if err := backoff(ctx, policy, resync); err != nil {
+			return err
+		}
+	}
+}
+
 // setup fpga for midstate calculation
-func (p *PiDiver) curlInitBlock() {
-	p.send(CMD_WRITE_FLAGS | FLAG_CURL_RESET)
+func (p *PiDiver) curlInitBlock() error {
+	return p.send(CMD_WRITE_FLAGS | FLAG_CURL_RESET)
+}
+
+// stop a running PoW and the midstate calculation
+func (p *PiDiver) abortPow() error {
+	return p.send(CMD_WRITE_FLAGS | FLAG_CURL_RESET)
+}
+
+// get the reservation of the FPGA - a stale reservation is reset once
+func (p *PiDiver) reserve(ctx context.Context) error {
+	err := p.waitForReservation(ctx, 5000*time.Millisecond)
+	if err == nil || errors.Is(err, ErrCancelled) {
+		return err
+	}
+	p.unlockReservation()
+	return p.waitForReservation(ctx, 5000*time.Millisecond)
 }
 
 // do PoW
 func (p *PiDiver) PowPiDiver(trytes Trytes, minWeight int, parallelism ...int) (Trytes, error) {
+	return p.PowPiDiverContext(context.Background(), trytes, minWeight)
+}
+
+// do PoW - stops and resets the FPGA when ctx is done
+func (p *PiDiver) PowPiDiverContext(ctx context.Context, trytes Trytes, minWeight int) (Trytes, error) {
+	report, err := p.PoWWithReport(ctx, trytes, minWeight)
+	if err != nil {
+		return "", err
+	}
+	return report.Nonce, nil
+}
+
+// do PoW and return the nonce with diagnostics
+func (p *PiDiver) PoWWithReport(ctx context.Context, trytes Trytes, minWeight int) (*PoWReport, error) {
+	if ctx.Err() != nil {
+		return nil, ErrCancelled
+	}
+	start := time.Now()
+	statsStart := p.stats.get()
+
 	// doesn't work on ftdiver because sharing feature doesn't exist
-	if p.Config.UseSharedLock && p.VersionMajor == 1 && p.VersionMinor == 1 {
-		err := p.waitForReservation(5000 * time.Millisecond)
-		if err != nil {
-			p.unlockReservation()
-			err := p.waitForReservation(5000 * time.Millisecond)
-			if err != nil {
-				return "", err
-			}
+	shared := p.Config.UseSharedLock && p.VersionMajor == 1 && p.VersionMinor == 1
+	if shared {
+		if err := p.reserve(ctx); err != nil {
+			return nil, err
 		}
 		defer p.unlockReservation()
 	}
 
 	// do mid-state-calculation on FPGA
-	midStateStart := makeTimestamp()
-	p.curlInitBlock()
-	for blocknr := 0; blocknr < 33; blocknr++ {
-		doCurl := true
-		if blocknr == 32 {
-			doCurl = false
-		}
-		if err := p.curlSendBlock(string(trytes)[blocknr*(HASH_LENGTH/3):(blocknr+1)*(HASH_LENGTH/3)], doCurl); err != nil {
-			return "", err
-		}
+	midStateStart := time.Now()
+	progress := p.progress(PhaseMidstate, 0)
+	err := p.midstate(ctx, trytes, shared)
+	progress.Done(err)
+	if err != nil {
+		return nil, err
 	}
-	midStateEnd := makeTimestamp()
+	midStateEnd := time.Now()
 
 	// write min weight magnitude
-	p.writeMinWeightMagnitude(uint32(minWeight))
+	if err := p.writeMinWeightMagnitude(uint32(minWeight)); err != nil {
+		return nil, err
+	}
 
 	// start PoW
-	p.startPow()
+	if err := p.startPow(); err != nil {
+		return nil, err
+	}
 
-	powStart := makeTimestamp()
+	powStart := time.Now()
+	progress = p.progress(PhasePoW, 0)
 	for {
 		flags, err := p.getFlags()
 		if err != nil {
-			return Trytes(""), err
+			progress.Done(err)
+			return nil, err
 		}
 
 		if (flags&FLAG_RUNNING) == 0 && ((flags&FLAG_FOUND) != 0 || (flags&FLAG_OVERFLOW) != 0) {
 			break
 		}
-		time.Sleep(1 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			p.abortPow()
+			progress.Done(ErrCancelled)
+			return nil, ErrCancelled
+		case <-time.After(1 * time.Millisecond):
+		}
 	}
-	powEnd := makeTimestamp()
+	powEnd := time.Now()
 
 	binary_nonce, err := p.readBinaryNonce()
 	if err != nil {
-		return Trytes(""), err
+		progress.Done(err)
+		return nil, err
 	}
 	binary_nonce -= 2 // -2 because of pipelining for speed on FPGA
+	progress.SetHashes(uint64(binary_nonce) * uint64(p.parallel))
+	progress.Done(nil)
 	mask, err := p.getMask()
-	log.Printf("Found nonce: %08x (mask: %08x)\n", binary_nonce, mask)
-	log.Printf("PoW-Time: %dms\n", (powEnd-powStart)+(midStateEnd-midStateStart))
+	if err != nil {
+		return nil, err
+	}
+	p.log(LevelDebug, "found nonce", F("nonce", fmt.Sprintf("%08x", binary_nonce)), F("mask", fmt.Sprintf("%08x", mask)))
+
+	nonce, err := assembleNonce(binary_nonce, mask, p.parallel)
+	if err != nil {
+		return nil, err
+	}
+	statsEnd := p.stats.get()
+
+	report := newReport(p.Info(), minWeight)
+	report.Nonce = nonce
+	report.Midstate = midStateEnd.Sub(midStateStart)
+	report.Search = powEnd.Sub(powStart)
+	report.Total = time.Since(start)
+	report.Counter = binary_nonce
+	report.Mask = mask
+	report.Hashes = uint64(binary_nonce) * uint64(p.parallel)
+	report.Retries = (statsEnd.Retries + statsEnd.Resyncs + statsEnd.Reinits) - (statsStart.Retries + statsStart.Resyncs + statsStart.Reinits)
+	p.log(LevelDebug, "pow done", F("time", report.Midstate+report.Search))
+	return report, nil
+}
+
+// upload the midstate - initialize the device again if it doesn't recover
+func (p *PiDiver) midstate(ctx context.Context, trytes Trytes, shared bool) error {
+	policy := p.retryPolicy()
+	for reinit := 0; ; reinit++ {
+		err := p.uploadMidstate(ctx, trytes)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrCancelled) {
+			p.abortPow()
+			return err
+		}
+		if reinit >= policy.Reinits {
+			p.stats.add(func(s *PiDiverStats) { s.GiveUps++ })
+			return &TransmissionError{Err: err}
+		}
+		p.stats.add(func(s *PiDiverStats) { s.Reinits++ })
+		p.log(LevelWarning, "midstate upload failed - reinitializing device", F("error", err), F("reinit", reinit+1), F("reinits", policy.Reinits))
+		if err := p.reinit(); err != nil {
+			p.stats.add(func(s *PiDiverStats) { s.GiveUps++ })
+			return err
+		}
+		if shared {
+			if err := p.reserve(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *PiDiver) progress(phase Phase, total int64) *Progress {
+	return NewProgress(p.Config.OnEvent, p.logger(), p.Config.Device, phase, total)
+}
+
+func (p *PiDiver) logger() Logger {
+	return WithFields(ConfigLogger(p.Config), F("device", p.Config.Device))
+}
 
-	return assembleNonce(binary_nonce, mask, p.parallel)
+func (p *PiDiver) log(level Level, msg string, fields ...Field) {
+	p.logger().Log(level, msg, fields...)
 }
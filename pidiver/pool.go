@@ -0,0 +1,348 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// DiverPool schedules PoW requests across several devices (any mix of backends).
+// Every request gets an idle device, devices which fail MaxFailures times in a row
+// (or are gone) are taken out of rotation. Recover (or StartRecovery) re-initializes
+// failed devices and puts them back.
+
+const (
+	DEFAULT_MAX_FAILURES = 3
+)
+
+type DeviceState int
+
+const (
+	DeviceIdle DeviceState = iota
+	DeviceBusy
+	DeviceFailed
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceIdle:
+		return "idle"
+	case DeviceBusy:
+		return "busy"
+	case DeviceFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+var ErrNoDevices = errors.New("no working device in pool")
+
+// DeviceStatus is a snapshot of a device in the pool
+type DeviceStatus struct {
+	Index     int
+	Info      DiverInfo
+	State     DeviceState
+	Failures  int    // consecutive failures
+	Requests  uint64 // successful PoWs
+	LastError error
+	Stats     *PiDiverStats // transmission counters (nil if the backend has none)
+}
+
+type poolDevice struct {
+	index     int
+	diver     Diver
+	state     DeviceState
+	failures  int
+	requests  uint64
+	lastError error
+	queued    bool // in idle channel
+}
+
+type DiverPool struct {
+	MaxFailures int
+	OnWait      func(wait time.Duration) // called with the time a request waited for an idle device
+
+	lock      sync.Mutex
+	devices   []*poolDevice
+	idle      chan *poolDevice
+	failed    chan struct{} // closed and replaced when a device fails
+	recovery  sync.Mutex    // one Recover at a time
+	stop      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+func NewDiverPool(divers ...Diver) *DiverPool {
+	p := &DiverPool{
+		MaxFailures: DEFAULT_MAX_FAILURES,
+		idle:        make(chan *poolDevice, len(divers)),
+		failed:      make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	for i, diver := range divers {
+		dev := &poolDevice{index: i, diver: diver, queued: true}
+		p.devices = append(p.devices, dev)
+		p.idle <- dev
+	}
+	return p
+}
+
+// number of devices in rotation
+func (p *DiverPool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := 0
+	for _, dev := range p.devices {
+		if dev.state != DeviceFailed {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *DiverPool) Devices() []DeviceStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := make([]DeviceStatus, len(p.devices))
+	for i, dev := range p.devices {
+		status[i] = DeviceStatus{
+			Index:     dev.index,
+			Info:      dev.diver.Info(),
+			State:     dev.state,
+			Failures:  dev.failures,
+			Requests:  dev.requests,
+			LastError: dev.lastError,
+		}
+		if diver, ok := dev.diver.(interface{ Stats() PiDiverStats }); ok {
+			stats := diver.Stats()
+			status[i].Stats = &stats
+		}
+	}
+	return status
+}
+
+// put a failed device back into rotation
+func (p *DiverPool) Restore(index int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if index < 0 || index >= len(p.devices) {
+		return errors.New("no such device")
+	}
+	dev := p.devices[index]
+	if dev.state != DeviceFailed {
+		return nil
+	}
+	dev.state = DeviceIdle
+	dev.failures = 0
+	if !dev.queued {
+		dev.queued = true
+		p.idle <- dev
+	}
+	return nil
+}
+
+// re-initialize the failed devices and put the ones which work again back into
+// rotation. Returns the number of restored devices.
+func (p *DiverPool) Recover() int {
+	p.recovery.Lock()
+	defer p.recovery.Unlock()
+
+	// failed devices are neither idle nor busy - nobody else uses them
+	var failed []*poolDevice
+	p.lock.Lock()
+	for _, dev := range p.devices {
+		if dev.state == DeviceFailed {
+			failed = append(failed, dev)
+		}
+	}
+	p.lock.Unlock()
+
+	restored := 0
+	for _, dev := range failed {
+		dev.diver.Close()
+		if err := dev.diver.Init(); err != nil {
+			p.lock.Lock()
+			dev.lastError = err
+			p.lock.Unlock()
+			GetLogger().Log(LevelDebug, "device still failing", F("device", dev.index), F("error", err))
+			continue
+		}
+		if err := p.Restore(dev.index); err != nil {
+			continue
+		}
+		GetLogger().Log(LevelInfo, "device back in rotation", F("device", dev.index), F("type", dev.diver.Info().Type))
+		restored++
+	}
+	return restored
+}
+
+// Recover every interval until the pool is closed
+func (p *DiverPool) StartRecovery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.Recover()
+			}
+		}
+	}()
+}
+
+// must be called with lock held
+func (p *DiverPool) setFailed(dev *poolDevice, err error) {
+	dev.state = DeviceFailed
+	dev.lastError = err
+	close(p.failed)
+	p.failed = make(chan struct{})
+}
+
+// wait for an idle device
+func (p *DiverPool) acquire(ctx context.Context) (*poolDevice, error) {
+	for {
+		if p.Size() == 0 {
+			return nil, ErrNoDevices
+		}
+		p.lock.Lock()
+		failed := p.failed
+		p.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ErrCancelled
+		case <-failed:
+			// check if there are devices left
+		case dev := <-p.idle:
+			p.lock.Lock()
+			dev.queued = false
+			if dev.state == DeviceFailed {
+				p.lock.Unlock()
+				continue
+			}
+			dev.state = DeviceBusy
+			p.lock.Unlock()
+			return dev, nil
+		}
+	}
+}
+
+func (p *DiverPool) release(dev *poolDevice, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil && !errors.Is(err, ErrCancelled) {
+		dev.failures++
+		dev.lastError = err
+		// no use retrying a device which is gone
+		if dev.failures >= p.MaxFailures || errors.Is(err, ErrDeviceGone) {
+			p.setFailed(dev, err)
+			return
+		}
+	} else if err == nil {
+		dev.failures = 0
+		dev.requests++
+	}
+	dev.state = DeviceIdle
+	dev.queued = true
+	p.idle <- dev
+}
+
+// Diver interface
+func (p *DiverPool) Init() error {
+	var errs []string
+	for _, dev := range p.devices {
+		if err := dev.diver.Init(); err != nil {
+			p.lock.Lock()
+			p.setFailed(dev, err)
+			p.lock.Unlock()
+			errs = append(errs, err.Error())
+		}
+	}
+	if p.Size() == 0 {
+		if len(errs) == 0 {
+			return ErrNoDevices
+		}
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *DiverPool) PoW(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return p.PoWContext(context.Background(), trytes, minWeight)
+}
+
+// do PoW on the next idle device. If the device fails, the next one is tried
+func (p *DiverPool) PoWContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	report, err := p.PoWWithReport(ctx, trytes, minWeight)
+	if err != nil {
+		return "", err
+	}
+	return report.Nonce, nil
+}
+
+// like PoWContext - the report is the one of the device which found the nonce
+func (p *DiverPool) PoWWithReport(ctx context.Context, trytes trinary.Trytes, minWeight int) (*PoWReport, error) {
+	var lastErr error
+	var wait time.Duration
+	for tries := 0; tries < len(p.devices); tries++ {
+		start := time.Now()
+		dev, err := p.acquire(ctx)
+		waited := time.Since(start)
+		wait += waited
+		if p.OnWait != nil {
+			p.OnWait(waited)
+		}
+		if err != nil {
+			if err == ErrNoDevices && lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		report, err := PoWWithReport(ctx, dev.diver, trytes, minWeight)
+		p.release(dev, err)
+		if err == nil {
+			report.Wait = wait
+			return report, nil
+		}
+		if errors.Is(err, ErrCancelled) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (p *DiverPool) Info() DiverInfo {
+	info := DiverInfo{Type: "pool"}
+	for _, status := range p.Devices() {
+		if status.State != DeviceFailed {
+			info.Parallel += status.Info.Parallel
+		}
+	}
+	return info
+}
+
+func (p *DiverPool) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	p.recovery.Lock()
+	defer p.recovery.Unlock()
+
+	var errs []string
+	for _, dev := range p.devices {
+		if err := dev.diver.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
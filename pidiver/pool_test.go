@@ -0,0 +1,206 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// emulator which can be held, broken and which counts its inits
+type testPoolDiver struct {
+	Diver
+
+	lock    sync.Mutex
+	gate    chan struct{} // PoW waits until it is closed (nil: doesn't wait)
+	err     error         // returned by PoW and Init
+	inits   int
+	started chan struct{} // gets a value when a PoW starts
+}
+
+func newTestPoolDiver() *testPoolDiver {
+	return &testPoolDiver{
+		Diver:   &PiDiver{LLStruct: NewEmulator(EMULATOR_PARALLEL).LowLevel(), Config: &PiDiverConfig{Type: "emulator"}},
+		started: make(chan struct{}, 16),
+	}
+}
+
+func (d *testPoolDiver) setErr(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.err = err
+}
+
+func (d *testPoolDiver) Init() error {
+	d.lock.Lock()
+	d.inits++
+	err := d.err
+	d.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.Diver.Init()
+}
+
+func (d *testPoolDiver) PoWContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	d.started <- struct{}{}
+	d.lock.Lock()
+	gate, err := d.gate, d.err
+	d.lock.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			// backends may wrap the cancellation
+			return "", fmt.Errorf("%w: while waiting", ErrCancelled)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return d.Diver.PoWContext(ctx, trytes, minWeight)
+}
+
+func newTestPool(t *testing.T, n int) (*DiverPool, []*testPoolDiver) {
+	var divers []*testPoolDiver
+	var poolDivers []Diver
+	for i := 0; i < n; i++ {
+		d := newTestPoolDiver()
+		divers = append(divers, d)
+		poolDivers = append(poolDivers, d)
+	}
+	pool := NewDiverPool(poolDivers...)
+	if err := pool.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool, divers
+}
+
+func TestPoolDispatchesToIdleDevices(t *testing.T) {
+	pool, divers := newTestPool(t, 2)
+	gate := make(chan struct{})
+	divers[0].gate = gate
+
+	// the first request holds device 0 - the second one gets device 1
+	done := make(chan error)
+	go func() {
+		nonce, err := pool.PoW(testTrytes, 9)
+		if err == nil {
+			checkNonce(t, testTrytes, nonce, 9)
+		}
+		done <- err
+	}()
+	<-divers[0].started
+	nonce, err := pool.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+	if devices := pool.Devices(); devices[0].State != DeviceBusy || devices[1].Requests != 1 {
+		t.Errorf("devices while device 0 is busy: %+v", devices)
+	}
+
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range pool.Devices() {
+		if status.State != DeviceIdle || status.Requests != 1 {
+			t.Errorf("device %d: %+v", status.Index, status)
+		}
+	}
+	if info := pool.Info(); info.Parallel != 2*EMULATOR_PARALLEL {
+		t.Errorf("info: %+v", info)
+	}
+}
+
+func TestPoolMaxFailures(t *testing.T) {
+	pool, divers := newTestPool(t, 1)
+	pool.MaxFailures = 3
+	failure := fmt.Errorf("%w: no response", ErrTimeout)
+	divers[0].setErr(failure)
+
+	for i := 1; i <= pool.MaxFailures; i++ {
+		if _, err := pool.PoW(testTrytes, 9); err != failure {
+			t.Fatalf("PoW %d: %v", i, err)
+		}
+		status := pool.Devices()[0]
+		if status.Failures != i || (status.State == DeviceFailed) != (i == pool.MaxFailures) {
+			t.Errorf("after %d failures: %+v", i, status)
+		}
+	}
+	if _, err := pool.PoW(testTrytes, 9); err != ErrNoDevices || pool.Size() != 0 {
+		t.Errorf("PoW without devices: %v", err)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	pool, divers := newTestPool(t, 2)
+	divers[0].setErr(fmt.Errorf("%w: unplugged", ErrDeviceGone))
+
+	// a device which is gone fails right away - the request is done by the next one
+	nonce, err := pool.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+	devices := pool.Devices()
+	if devices[0].State != DeviceFailed || devices[0].Failures != 1 || devices[1].Requests != 1 || pool.Size() != 1 {
+		t.Errorf("devices: %+v", devices)
+	}
+}
+
+func TestPoolCancelIsNoFailure(t *testing.T) {
+	pool, divers := newTestPool(t, 1)
+	divers[0].gate = make(chan struct{})
+
+	for i := 0; i <= pool.MaxFailures; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := pool.PoWContext(ctx, testTrytes, 9)
+		cancel()
+		if !errors.Is(err, ErrCancelled) {
+			t.Fatalf("PoW %d: %v", i, err)
+		}
+	}
+	if status := pool.Devices()[0]; status.State != DeviceIdle || status.Failures != 0 {
+		t.Errorf("device after cancels: %+v", status)
+	}
+}
+
+func TestPoolRecover(t *testing.T) {
+	pool, divers := newTestPool(t, 1)
+	divers[0].setErr(ErrDeviceGone)
+	if _, err := pool.PoW(testTrytes, 9); err != ErrDeviceGone || pool.Size() != 0 {
+		t.Fatalf("device not failed: %v", err)
+	}
+
+	// still broken
+	if restored := pool.Recover(); restored != 0 || pool.Size() != 0 {
+		t.Errorf("broken device restored")
+	}
+
+	divers[0].setErr(nil)
+	pool.StartRecovery(5 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Size() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("device not recovered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	nonce, err := pool.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+	divers[0].lock.Lock()
+	defer divers[0].lock.Unlock()
+	if divers[0].inits < 3 {
+		t.Errorf("%d inits", divers[0].inits)
+	}
+}
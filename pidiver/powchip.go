@@ -2,8 +2,10 @@ package pidiver
 
 import (
 	"bytes"
-	"errors"
-	"log"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/iotaledger/iota.go/trinary"
 	"github.com/lunixbochs/struc"
@@ -13,10 +15,46 @@ type PoWChipDiver struct {
 	USBDiver *USBDiver
 }
 
+// Diver interface
+func (u *PoWChipDiver) Init() error {
+	return u.USBDiver.InitUSBDiver()
+}
+
+func (u *PoWChipDiver) PoW(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return u.PowPoWChipDiver(trytes, minWeight, parallelism...)
+}
+
+func (u *PoWChipDiver) PoWContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	return u.PowPoWChipDiverContext(ctx, trytes, minWeight)
+}
+
+func (u *PoWChipDiver) Info() DiverInfo {
+	return u.USBDiver.Info()
+}
+
+func (u *PoWChipDiver) Close() error {
+	return u.USBDiver.Close()
+}
+
 // do PoW
 func (u *PoWChipDiver) PowPoWChipDiver(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return u.PowPoWChipDiverContext(context.Background(), trytes, minWeight)
+}
+
+// do PoW - stops waiting for the chip when ctx is done
+func (u *PoWChipDiver) PowPoWChipDiverContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	report, err := u.PoWWithReport(ctx, trytes, minWeight)
+	if err != nil {
+		return "", err
+	}
+	return report.Nonce, nil
+}
+
+// do PoW and return the nonce with diagnostics
+func (u *PoWChipDiver) PoWWithReport(ctx context.Context, trytes trinary.Trytes, minWeight int) (*PoWReport, error) {
 	// do mid-state-calculation on FPGA
 	//	var start int64 = makeTimestamp()
+	start := time.Now()
 
 	com := Com{Cmd: CMD_DO_POW}
 
@@ -29,25 +67,40 @@ func (u *PoWChipDiver) PowPoWChipDiver(trytes trinary.Trytes, minWeight int, par
 	var tmpBuffer bytes.Buffer
 	err := struc.Pack(&tmpBuffer, &data)
 	if err != nil {
-		return trinary.Trytes(""), err
+		return nil, err
 	}
 	copy(com.Data[0:], tmpBuffer.Bytes())
 
-	com.Length = 3700                           // (891 + 33 + 1) * 4
-	_, err = u.USBDiver.usbRequest(&com, 60000) // 10sec enough?
+	com.Length = 3700                                       // (891 + 33 + 1) * 4
+	_, err = u.USBDiver.usbRequestContext(ctx, &com, 60000) // 10sec enough?
 	if err != nil {
-		return trinary.Trytes(""), err
+		return nil, err
 	}
 
 	var powResult PoWResult
 	if err := struc.Unpack(bytes.NewReader(com.Data[0:com.Length]), &powResult); err != nil {
-		return trinary.Trytes(""), errors.New("error unpack pow results")
+		return nil, fmt.Errorf("%w: error unpack pow results", ErrProtocol)
 	}
 
-	log.Printf("Found nonce: %08x (mask: %08x)\n", powResult.Nonce, powResult.Mask)
-	log.Printf("PoW-Time: %dms (%.2fMH/s)\n", powResult.Time, 1.0/(float32(powResult.Time+1)/1000.0)*float32(powResult.Nonce*powResult.Parallel)/1000000.0)
+	u.USBDiver.log(LevelDebug, "found nonce", F("nonce", fmt.Sprintf("%08x", powResult.Nonce)), F("mask", fmt.Sprintf("%08x", powResult.Mask)))
+	u.USBDiver.log(LevelDebug, "pow done", F("time", fmt.Sprintf("%dms", powResult.Time)),
+		F("rate", fmt.Sprintf("%.2fMH/s", 1.0/(float32(powResult.Time+1)/1000.0)*float32(powResult.Nonce*powResult.Parallel)/1000000.0)))
+
+	atomic.StoreUint32(&u.USBDiver.parallel, powResult.Parallel)
 
-	return u.assembleNonce(powResult.Nonce, powResult.Mask, powResult.Parallel)
+	nonce, err := u.assembleNonce(powResult.Nonce, powResult.Mask, powResult.Parallel)
+	if err != nil {
+		return nil, err
+	}
+	report := newReport(u.Info(), minWeight)
+	report.Nonce = nonce
+	report.Search = msDuration(int64(powResult.Time))
+	report.Total = time.Since(start)
+	report.Counter = powResult.Nonce
+	report.Mask = powResult.Mask
+	report.Parallel = powResult.Parallel
+	report.Hashes = uint64(powResult.Nonce) * uint64(powResult.Parallel)
+	return report, nil
 }
 
 func (u *PoWChipDiver) assembleNonce(nonce uint32, mask uint32, parallel uint32) (trinary.Trytes, error) {
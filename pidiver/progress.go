@@ -0,0 +1,129 @@
+package pidiver
+
+import (
+	"fmt"
+	"time"
+)
+
+// typed progress of long running device operations. Every phase starts with an
+// event with Percent 0 and ends with an event with Done set. In between, events
+// are sent when the percentage changes. Handlers are called from the goroutine
+// doing the work and shouldn't block.
+
+type Phase int
+
+const (
+	PhaseConfigure    Phase = iota // fpga configuration
+	PhaseFlashErase                // chip erase
+	PhaseFlashCompare              // reading back pages of an incremental update
+	PhaseFlashWrite                // programming pages
+	PhaseFlashVerify               // comparing flash with the core
+	PhaseFlashMeta                 // writing the meta page
+	PhaseFlashRead                 // dumping flash
+	PhaseMidstate                  // midstate calculation and upload
+	PhasePoW                       // nonce search
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseConfigure:
+		return "configure"
+	case PhaseFlashErase:
+		return "flash erase"
+	case PhaseFlashCompare:
+		return "flash compare"
+	case PhaseFlashWrite:
+		return "flash write"
+	case PhaseFlashVerify:
+		return "flash verify"
+	case PhaseFlashMeta:
+		return "flash meta"
+	case PhaseFlashRead:
+		return "flash read"
+	case PhaseMidstate:
+		return "midstate"
+	case PhasePoW:
+		return "pow"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Device  string // Config.Device of the diver
+	Phase   Phase
+	Percent float64       // 0..100 (0 while Total is unknown)
+	Bytes   int64         // bytes processed
+	Total   int64         // bytes of the phase (0: unknown)
+	Elapsed time.Duration // since start of the phase
+	Done    bool          // phase finished - Err is set if it failed
+	Err     error
+	Hashes  uint64 // PhasePoW: hashes calculated for the nonce (nonce counter * parallel level)
+}
+
+type EventHandler func(Event)
+
+// progress of one phase
+type Progress struct {
+	handler EventHandler
+	logger  Logger
+	event   Event
+	start   time.Time
+	percent int // last reported percentage
+}
+
+// handler and logger can be nil
+func NewProgress(handler EventHandler, logger Logger, device string, phase Phase, total int64) *Progress {
+	if logger == nil {
+		logger = NopLogger
+	}
+	p := &Progress{
+		handler: handler,
+		logger:  logger,
+		event:   Event{Device: device, Phase: phase, Total: total},
+		start:   time.Now(),
+		percent: -1,
+	}
+	p.Update(0)
+	return p
+}
+
+// bytes processed so far
+func (p *Progress) Update(bytes int64) {
+	p.event.Bytes = bytes
+	percent := 0
+	if p.event.Total > 0 {
+		p.event.Percent = float64(bytes) / float64(p.event.Total) * 100.0
+		percent = int(p.event.Percent)
+	}
+	if percent == p.percent {
+		return
+	}
+	p.percent = percent
+	if p.event.Total > 0 && percent > 0 {
+		p.logger.Log(LevelInfo, fmt.Sprintf("%d%% %s ...", percent, p.event.Phase))
+	}
+	p.emit()
+}
+
+// set the hashes which are reported with Done
+func (p *Progress) SetHashes(hashes uint64) {
+	p.event.Hashes = hashes
+}
+
+func (p *Progress) Done(err error) {
+	if err == nil && p.event.Total > 0 {
+		p.event.Bytes = p.event.Total
+		p.event.Percent = 100.0
+	}
+	p.event.Done = true
+	p.event.Err = err
+	p.emit()
+}
+
+func (p *Progress) emit() {
+	if p.handler == nil {
+		return
+	}
+	p.event.Elapsed = time.Since(p.start)
+	p.handler(p.event)
+}
@@ -0,0 +1,89 @@
+package pidiver
+
+import (
+	"context"
+	"time"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// PoWReport is the nonce of a PoW with the diagnostics of the device which found it
+type PoWReport struct {
+	Nonce     trinary.Trytes
+	Type      string // registered type of the backend
+	Device    string // device file (if any)
+	Version   string // firmware or fpga core version
+	MinWeight int
+
+	Wait     time.Duration // waiting for an idle device (pool only)
+	Midstate time.Duration // midstate calculation (0 if done by the device)
+	Search   time.Duration // nonce search (measured by the device if it reports it)
+	Total    time.Duration // whole PoW incl. transfers
+
+	Counter  uint32 // binary nonce counter when the nonce was found
+	Mask     uint32 // parallel units which found the nonce
+	Parallel uint32 // number of parallel units
+	Hashes   uint64 // counter * parallel
+	Retries  uint64 // re-sent blocks, resyncs and reinits during the PoW
+}
+
+// hashes per second of the nonce search
+func (r *PoWReport) HashRate() float64 {
+	if r.Search <= 0 {
+		return 0
+	}
+	return float64(r.Hashes) / r.Search.Seconds()
+}
+
+// ReportingDiver is implemented by backends which return the diagnostics of a PoW
+type ReportingDiver interface {
+	Diver
+	// like PoWContext but returns the nonce with diagnostics
+	PoWWithReport(ctx context.Context, trytes trinary.Trytes, minWeight int) (*PoWReport, error)
+}
+
+// PoWWithReport does PoW on diver. For backends without diagnostics the report only has the timing
+func PoWWithReport(ctx context.Context, diver Diver, trytes trinary.Trytes, minWeight int) (*PoWReport, error) {
+	if diver, ok := diver.(ReportingDiver); ok {
+		return diver.PoWWithReport(ctx, trytes, minWeight)
+	}
+	start := time.Now()
+	nonce, err := diver.PoWContext(ctx, trytes, minWeight)
+	if err != nil {
+		return nil, err
+	}
+	report := newReport(diver.Info(), minWeight)
+	report.Nonce = nonce
+	report.Total = time.Since(start)
+	report.Search = report.Total
+	return report, nil
+}
+
+// ProofOfWorkFunc returns a pow.ProofOfWorkFunc compatible function which does PoW on
+// diver and calls onReport (if not nil) with the diagnostics of every PoW
+func ProofOfWorkFunc(diver Diver, onReport func(report *PoWReport)) func(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return func(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+		report, err := PoWWithReport(context.Background(), diver, trytes, minWeight)
+		if err != nil {
+			return "", err
+		}
+		if onReport != nil {
+			onReport(report)
+		}
+		return report.Nonce, nil
+	}
+}
+
+func newReport(info DiverInfo, minWeight int) *PoWReport {
+	return &PoWReport{
+		Type:      info.Type,
+		Device:    info.Device,
+		Version:   info.Version,
+		MinWeight: minWeight,
+		Parallel:  info.Parallel,
+	}
+}
+
+func msDuration(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,100 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// recovery of transmission errors during the midstate upload:
+// 1. a block with CRC/transport error is sent again (BlockRetries)
+// 2. if a block keeps failing the curl state is reset and all blocks are sent again (Resyncs)
+// 3. if this doesn't help the device is initialized again (Reinits)
+
+var ErrTransmission = errors.New("transmission error - giving up")
+
+type RetryPolicy struct {
+	BlockRetries int           // retries of a single block
+	Resyncs      int           // curl resets and re-sending of all blocks
+	Reinits      int           // re-initializations of the device
+	Backoff      time.Duration // wait before the first retry, doubled on every retry
+	MaxBackoff   time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	BlockRetries: 3,
+	Resyncs:      2,
+	Reinits:      1,
+	Backoff:      1 * time.Millisecond,
+	MaxBackoff:   100 * time.Millisecond,
+}
+
+// counters since the device was created
+type PiDiverStats struct {
+	CRCErrors       uint64 // crc mismatches of blocks
+	TransportErrors uint64 // failed spi transfers
+	Retries         uint64 // re-sent blocks
+	Resyncs         uint64
+	Reinits         uint64
+	GiveUps         uint64 // PoWs which failed after all retries
+}
+
+type retryStats struct {
+	lock  sync.Mutex
+	stats PiDiverStats
+}
+
+func (s *retryStats) add(f func(stats *PiDiverStats)) {
+	s.lock.Lock()
+	f(&s.stats)
+	s.lock.Unlock()
+}
+
+func (s *retryStats) get() PiDiverStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+func (p *PiDiver) retryPolicy() *RetryPolicy {
+	if p.Config == nil || p.Config.Retry == nil {
+		return &DefaultRetryPolicy
+	}
+	return p.Config.Retry
+}
+
+func (p *PiDiver) Stats() PiDiverStats {
+	return p.stats.get()
+}
+
+// wait before retry number n (starting with 0)
+func backoff(ctx context.Context, policy *RetryPolicy, n int) error {
+	wait := policy.Backoff
+	for i := 0; i < n && wait < policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if policy.MaxBackoff > 0 && wait > policy.MaxBackoff {
+		wait = policy.MaxBackoff
+	}
+	if wait <= 0 {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ErrCancelled
+	case <-time.After(wait):
+	}
+	return nil
+}
+
+// close and initialize the device again
+func (p *PiDiver) reinit() error {
+	if p.LLStruct.LLClose != nil {
+		p.LLStruct.LLClose()
+	}
+	return p.InitPiDiver()
+}
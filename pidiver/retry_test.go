@@ -0,0 +1,190 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// emulator with transmission errors
+type faultyLL struct {
+	ll LLStruct
+
+	lock     sync.Mutex
+	badCRCs  int               // the next CRC32 reads return a wrong value (-1: all)
+	failSend func(uint32) bool // sends for which it returns true fail
+	inits    int
+}
+
+func newFaultyPiDiver(t *testing.T, policy *RetryPolicy) (*PiDiver, *faultyLL) {
+	f := &faultyLL{ll: NewEmulator(EMULATOR_PARALLEL).LowLevel()}
+	diver := &PiDiver{
+		LLStruct: LLStruct{
+			LLInit:           f.init,
+			LLSPISend:        f.send,
+			LLSPISendBlock:   f.ll.LLSPISendBlock,
+			LLSPISendReceive: f.sendReceive,
+			LLClose:          f.ll.LLClose,
+		},
+		Config: &PiDiverConfig{Type: "emulator", UseCRC: true, Retry: policy},
+	}
+	if err := diver.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diver.Close() })
+	return diver, f
+}
+
+func (f *faultyLL) init(config *PiDiverConfig) error {
+	f.lock.Lock()
+	f.inits++
+	f.lock.Unlock()
+	return f.ll.LLInit(config)
+}
+
+func (f *faultyLL) send(data uint32) error {
+	f.lock.Lock()
+	fail := f.failSend != nil && f.failSend(data)
+	f.lock.Unlock()
+	if fail {
+		return fmt.Errorf("%w: spi transfer failed", ErrProtocol)
+	}
+	return f.ll.LLSPISend(data)
+}
+
+func (f *faultyLL) sendReceive(cmd uint32) (uint32, error) {
+	value, err := f.ll.LLSPISendReceive(cmd)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if cmd == CMD_READ_CRC32 && f.badCRCs != 0 {
+		if f.badCRCs > 0 {
+			f.badCRCs--
+		}
+		value = ^value
+	}
+	return value, err
+}
+
+func (f *faultyLL) setBadCRCs(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.badCRCs = n
+}
+
+var testRetryPolicy = RetryPolicy{BlockRetries: 2, Resyncs: 1, Reinits: 1, Backoff: time.Microsecond, MaxBackoff: time.Millisecond}
+
+// PoW with transmission errors - the nonce has to be valid anyway
+func faultyPoW(t *testing.T, diver *PiDiver) *PoWReport {
+	t.Helper()
+	report, err := diver.PoWWithReport(context.Background(), testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, report.Nonce, 9)
+	return report
+}
+
+func checkStats(t *testing.T, stats PiDiverStats, expected PiDiverStats) {
+	t.Helper()
+	if stats != expected {
+		t.Errorf("stats %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestRetryBlock(t *testing.T) {
+	diver, f := newFaultyPiDiver(t, &testRetryPolicy)
+	f.setBadCRCs(testRetryPolicy.BlockRetries)
+
+	report := faultyPoW(t, diver)
+	if report.Retries != 2 {
+		t.Errorf("report: %d retries", report.Retries)
+	}
+	checkStats(t, diver.Stats(), PiDiverStats{CRCErrors: 2, Retries: 2})
+}
+
+func TestRetryResync(t *testing.T) {
+	diver, f := newFaultyPiDiver(t, &testRetryPolicy)
+	// the block fails after all its retries - all blocks are sent again
+	f.setBadCRCs(testRetryPolicy.BlockRetries + 1)
+
+	faultyPoW(t, diver)
+	checkStats(t, diver.Stats(), PiDiverStats{CRCErrors: 3, Retries: 2, Resyncs: 1})
+}
+
+func TestRetryReinit(t *testing.T) {
+	diver, f := newFaultyPiDiver(t, &testRetryPolicy)
+	// every resync fails too - the device is initialized again
+	f.setBadCRCs((testRetryPolicy.BlockRetries + 1) * (testRetryPolicy.Resyncs + 1))
+
+	faultyPoW(t, diver)
+	checkStats(t, diver.Stats(), PiDiverStats{CRCErrors: 6, Retries: 4, Resyncs: 1, Reinits: 1})
+	if f.inits != 2 {
+		t.Errorf("%d inits", f.inits)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	diver, f := newFaultyPiDiver(t, &testRetryPolicy)
+	f.setBadCRCs(-1)
+
+	_, err := diver.PoW(testTrytes, 9)
+	if !errors.Is(err, ErrTransmission) || !errors.Is(err, ErrCRC) {
+		t.Fatalf("PoW with broken transmission: %v", err)
+	}
+	checkStats(t, diver.Stats(), PiDiverStats{CRCErrors: 12, Retries: 8, Resyncs: 2, Reinits: 1, GiveUps: 1})
+
+	// the device works again when the transmission does
+	f.setBadCRCs(0)
+	faultyPoW(t, diver)
+}
+
+func TestRetryCurlInitError(t *testing.T) {
+	diver, f := newFaultyPiDiver(t, &testRetryPolicy)
+	failed := false
+	f.failSend = func(data uint32) bool {
+		if data == CMD_WRITE_FLAGS|FLAG_CURL_RESET && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+
+	faultyPoW(t, diver)
+	checkStats(t, diver.Stats(), PiDiverStats{TransportErrors: 1, Resyncs: 1})
+}
+
+func TestRetryMinWeightMagnitudeError(t *testing.T) {
+	diver, f := newFaultyPiDiver(t, &testRetryPolicy)
+	f.failSend = func(data uint32) bool {
+		return data&0xfc000000 == CMD_WRITE_MIN_WEIGHT_MAGNITUDE
+	}
+
+	if _, err := diver.PoW(testTrytes, 9); !errors.Is(err, ErrProtocol) {
+		t.Errorf("PoW without min weight magnitude: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 2 * time.Millisecond, MaxBackoff: 8 * time.Millisecond}
+	for n, min := range []time.Duration{2, 4, 8, 8} {
+		start := time.Now()
+		if err := backoff(context.Background(), policy, n); err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited < min*time.Millisecond {
+			t.Errorf("backoff %d: waited %v", n, waited)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := backoff(ctx, &RetryPolicy{Backoff: time.Hour}, 0); !errors.Is(err, ErrCancelled) {
+		t.Errorf("cancelled backoff: %v", err)
+	}
+	if err := backoff(ctx, &RetryPolicy{}, 0); !errors.Is(err, ErrCancelled) {
+		t.Errorf("cancelled backoff without wait: %v", err)
+	}
+}
@@ -1,7 +1,7 @@
 package pidiver
 
 import (
-	"errors"
+	"fmt"
 	"time"
 
 //	"github.com/iotaledger/iota.go/transaction"
@@ -106,12 +106,17 @@ const (
 )
 
 type PiDiverConfig struct {
+	Type           string // registered backend name (see RegisterDiver)
 	Device         string
 	ConfigFile     string
 	ForceFlash     bool
 	ForceConfigure bool
 	UseCRC         bool
 	UseSharedLock  bool	// pidiver/usbdiver sharing lock
+	Retry          *RetryPolicy // recovery of transmission errors (nil: DefaultRetryPolicy)
+	Board          string       // board profile - built-in name or json/toml file (empty: default of the backend)
+	OnEvent        EventHandler // progress of configuring, flashing and PoW (can be nil)
+	Logger         Logger       // nil: logger of SetLogger
 }
 
 var crctab = []uint32{
@@ -282,12 +287,23 @@ func initTryteMap() {
 }
 
 func assembleNonce(nonce uint32, mask uint32, parallel uint32) (trinary.Trytes, error) {
+	nonceTrits, err := assembleNonceTrits(nonce, mask, parallel)
+	if err != nil {
+		return trinary.Trytes(""), err
+	}
+
+	trytes, _ := trinary.TritsToTrytes(nonceTrits)
+
+	return trytes, nil
+}
+
+func assembleNonceTrits(nonce uint32, mask uint32, parallel uint32) (trinary.Trits, error) {
 	if parallel == 0 || parallel > 8 {
-		return trinary.Trytes(""), errors.New("wrong parallel level read")
+		return nil, fmt.Errorf("%w: wrong parallel level read", ErrProtocol)
 	}
 
 	if mask == 0 {
-		return trinary.Trytes(""), errors.New("zero-mask returned")
+		return nil, fmt.Errorf("%w: zero-mask returned", ErrProtocol)
 	}
 
 	// log2(parallel)
@@ -299,7 +315,7 @@ func assembleNonce(nonce uint32, mask uint32, parallel uint32) (trinary.Trytes,
 	}
 
 	if mask == 0 {
-		return "", errors.New("Returned Mask Zero")
+		return nil, fmt.Errorf("%w: returned mask zero", ErrProtocol)
 	}
 
 	// find set bit in mask
@@ -341,13 +357,11 @@ func assembleNonce(nonce uint32, mask uint32, parallel uint32) (trinary.Trytes,
 		bitsHi[NONCE_TRINARY_SIZE-32+i] = uint8(((^nonce) >> uint32(i)) & 0x1)
 	}
 
-	// convert trits to trytes
+	// convert bits to trits
 	nonceTrits := make([]int8, NONCE_TRINARY_SIZE)
 	for i := 0; i < NONCE_TRINARY_SIZE; i++ {
 		nonceTrits[i] = bitsToTrits(bitsHi[i], bitsLo[i])
 	}
 
-	trytes,_ := trinary.TritsToTrytes(nonceTrits)
-
-	return trytes, nil
+	return nonceTrits, nil
 }
@@ -0,0 +1,318 @@
+package pidiver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/iotaledger/iota.go/trinary"
+	"github.com/lunixbochs/struc"
+)
+
+// in-process USBDiver which speaks the Com protocol of the firmware. It can be
+// used instead of the serial port for tests and demos (type "usbdiver_virtual")
+
+const (
+	VIRTUAL_USB_PARALLEL      = 8
+	VIRTUAL_USB_VERSION_MAJOR = 1
+	VIRTUAL_USB_VERSION_MINOR = 1
+	VIRTUAL_USB_READ_TIMEOUT  = 100 * time.Millisecond
+
+	CMD_LOOP_TEST = uint8(0xaa)
+)
+
+var errUnknownCommand = errors.New("unknown command")
+
+func init() {
+	RegisterDiver("usbdiver_virtual", func(config *PiDiverConfig) (Diver, error) {
+		return NewUSBDiverWithPort(config, NewVirtualUSBDevice()), nil
+	})
+}
+
+type VirtualUSBDevice struct {
+	Parallel     uint32
+	VersionMajor uint32
+	VersionMinor uint32
+	Workers      int // goroutines used for nonce search (0: number of cpus)
+
+	// parser state of the received bytes
+	state uint8
+	com   Com
+	count uint16
+
+	requests chan Com
+	stop     chan struct{}
+	closed   bool
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	out        bytes.Buffer
+	flash      []uint8
+	page       uint32
+	configured bool
+}
+
+func NewVirtualUSBDevice() *VirtualUSBDevice {
+	d := &VirtualUSBDevice{
+		Parallel:     VIRTUAL_USB_PARALLEL,
+		VersionMajor: VIRTUAL_USB_VERSION_MAJOR,
+		VersionMinor: VIRTUAL_USB_VERSION_MINOR,
+		requests:     make(chan Com, 16),
+		stop:         make(chan struct{}),
+		flash:        bytes.Repeat([]uint8{0xff}, FLASH_SIZE),
+	}
+	d.cond = sync.NewCond(&d.lock)
+	go d.run()
+	return d
+}
+
+// bytes from host to device
+func (d *VirtualUSBDevice) Write(data []byte) (int, error) {
+	d.lock.Lock()
+	closed := d.closed
+	d.lock.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	for _, b := range data {
+		switch d.state {
+		case STATE_ID:
+			d.com = Com{Id: b}
+			d.count = 0
+			d.state = STATE_COMMAND
+		case STATE_COMMAND:
+			d.com.Cmd = b
+			d.state = STATE_CRC8
+		case STATE_CRC8:
+			d.com.Crc8 = b
+			d.state = STATE_LENGTH_LOW
+		case STATE_LENGTH_LOW:
+			d.com.Length = uint16(b)
+			d.state = STATE_LENGTH_HIGH
+		case STATE_LENGTH_HIGH:
+			d.com.Length |= uint16(b) << 8
+			d.state = STATE_DATA
+			if d.com.Length > MAX_DATA_LENGTH {
+				d.state = STATE_ID
+				d.reply([]byte{'X'})
+			} else if d.com.Length == 0 {
+				d.state = STATE_ID
+				d.requests <- d.com
+			}
+		case STATE_DATA:
+			d.com.Data[d.count] = b
+			d.count++
+			if d.count == d.com.Length {
+				d.state = STATE_ID
+				if crc8_messagecalc(d.com.Data[:], int(d.com.Length)) != d.com.Crc8 {
+					d.reply([]byte{'X'})
+					continue
+				}
+				d.requests <- d.com
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// bytes from device to host - returns 0 bytes after the read timeout like the serial port
+func (d *VirtualUSBDevice) Read(data []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	deadline := time.Now().Add(VIRTUAL_USB_READ_TIMEOUT)
+	for d.out.Len() == 0 && !d.closed {
+		if time.Now().After(deadline) {
+			return 0, nil
+		}
+		// wake up for the timeout
+		timer := time.AfterFunc(time.Until(deadline), d.cond.Broadcast)
+		d.cond.Wait()
+		timer.Stop()
+	}
+	if d.closed {
+		return 0, io.EOF
+	}
+	return d.out.Read(data)
+}
+
+func (d *VirtualUSBDevice) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.stop)
+	d.cond.Broadcast()
+	return nil
+}
+
+func (d *VirtualUSBDevice) reply(data []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.out.Write(data)
+	d.cond.Broadcast()
+}
+
+// send response with the id and command of the request
+func (d *VirtualUSBDevice) respond(com *Com, data []byte) {
+	if len(data) == 0 {
+		// host waits for at least one data byte
+		data = []byte{0}
+	}
+	resp := Com{Id: com.Id, Cmd: com.Cmd, Length: uint16(len(data))}
+	copy(resp.Data[:], data)
+	resp.Crc8 = crc8_messagecalc(resp.Data[:], int(resp.Length))
+
+	var buf bytes.Buffer
+	if err := struc.Pack(&buf, &resp); err != nil {
+		d.reply([]byte{'X'})
+		return
+	}
+	d.reply(buf.Bytes()[0 : 5+int(resp.Length)])
+}
+
+// the firmware executes one command after another
+func (d *VirtualUSBDevice) run() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		case com := <-d.requests:
+			data, err := d.execute(&com)
+			if err == errUnknownCommand {
+				// the firmware doesn't answer unknown commands
+				continue
+			}
+			if err != nil {
+				d.reply([]byte{'X'})
+				continue
+			}
+			d.respond(&com, data)
+		}
+	}
+}
+
+func pack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := struc.Pack(&buf, v)
+	return buf.Bytes(), err
+}
+
+func (d *VirtualUSBDevice) execute(com *Com) ([]byte, error) {
+	data := com.Data[0:com.Length]
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch com.Cmd {
+	case CMD_GET_VERSION:
+		return pack(&Version{Major: d.VersionMajor, Minor: d.VersionMinor})
+	case CMD_READ_STATUS:
+		status := Status{}
+		if d.configured {
+			status.IsFPGAConfigured = 1
+		}
+		return pack(&status)
+	case CMD_FLASH_ERASE:
+		for i := range d.flash {
+			d.flash[i] = 0xff
+		}
+		return nil, nil
+	case CMD_SET_PAGE:
+		if len(data) != 4 {
+			return nil, errors.New("wrong length")
+		}
+		page := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		if page > FLASH_META_PAGE {
+			return nil, errors.New("page out of range")
+		}
+		d.page = page
+		return nil, nil
+	case CMD_WRITE_PAGE:
+		// NOR flash - programming can only clear bits
+		flashPage := d.flash[d.page*FLASH_SPI_PAGESIZE : (d.page+1)*FLASH_SPI_PAGESIZE]
+		for i := 0; i < len(data) && i < FLASH_SPI_PAGESIZE; i++ {
+			flashPage[i] &= data[i]
+		}
+		return nil, nil
+	case CMD_READ_PAGE:
+		return d.flash[d.page*FLASH_SPI_PAGESIZE : (d.page+1)*FLASH_SPI_PAGESIZE], nil
+	case CMD_CONFIGURE_FPGA:
+		// configure from flash
+		var meta Meta
+		if err := struc.Unpack(bytes.NewReader(d.flash[FLASH_META_PAGE*FLASH_SPI_PAGESIZE:]), &meta); err != nil {
+			return nil, err
+		}
+		if meta.Timestamp == 0xffffffffffffffff || meta.Filesize == 0 {
+			return nil, errors.New("flash is empty")
+		}
+		d.configured = true
+		return nil, nil
+	case CMD_CONFIGURE_FPGA_START:
+		d.configured = false
+		return nil, nil
+	case CMD_CONFIGURE_FPGA_BLOCK:
+		// the fpga is configured as soon as it got data
+		d.configured = len(data) > 0
+		return nil, nil
+	case CMD_LOOP_TEST:
+		return data, nil
+	case CMD_DO_POW:
+		if !d.configured {
+			return nil, ErrNotConfigured
+		}
+		var trytesData TrytesData
+		if err := struc.Unpack(bytes.NewReader(data), &trytesData); err != nil {
+			return nil, err
+		}
+		// search without holding the lock
+		d.lock.Unlock()
+		result := d.doPow(&trytesData)
+		d.lock.Lock()
+		return pack(&result)
+	}
+	return nil, errUnknownCommand
+}
+
+// the search only stops when the device is closed - like the firmware it can't be aborted
+func (d *VirtualUSBDevice) doPow(data *TrytesData) PoWResult {
+	start := time.Now()
+
+	// midstate from the data words
+	state := make(trinary.Trits, STATE_LENGTH)
+	block := make(trinary.Trits, HASH_LENGTH)
+	words := HASH_LENGTH / DATA_WIDTH
+	for blocknr := 0; blocknr < 33; blocknr++ {
+		for i := 0; i < words; i++ {
+			word := data.Data[blocknr*words+i]
+			for j := uint32(0); j < DATA_WIDTH; j++ {
+				block[i*DATA_WIDTH+int(j)] = bitsToTrits(uint8((word>>(j+DATA_WIDTH))&0x1), uint8((word>>j)&0x1))
+			}
+		}
+		curlAbsorb(state, block, blocknr != 32)
+	}
+
+	parallel := d.Parallel
+	counters := uint64(LANES / parallel)
+	fill, err := pidiverLaneFiller(parallel, counters)
+	if err != nil {
+		return PoWResult{}
+	}
+	batch, lanes, found := searchNonce(state, int(data.MWM), d.Workers, uint64(0xffffffff)/counters, fill, d.stop)
+	if !found {
+		return PoWResult{Parallel: parallel, Time: uint32(time.Since(start) / time.Millisecond)}
+	}
+
+	k, mask := firstHit(lanes, parallel)
+	return PoWResult{
+		Nonce:    uint32(batch*counters + k),
+		Mask:     mask,
+		Parallel: parallel,
+		Time:     uint32(time.Since(start) / time.Millisecond),
+	}
+}
@@ -0,0 +1,74 @@
+package pidiver
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// port which calls cancel as soon as a PoW was sent
+type cancelOnPoW struct {
+	*VirtualUSBDevice
+	cancel context.CancelFunc
+}
+
+func (p *cancelOnPoW) Write(data []byte) (int, error) {
+	n, err := p.VirtualUSBDevice.Write(data)
+	if data[1] == CMD_DO_POW && p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	return n, err
+}
+
+// virtual USBDiver initialized with the small test core
+func newTestUSBDiver(t *testing.T) (*USBDiver, *cancelOnPoW) {
+	config := &PiDiverConfig{Type: "usbdiver_virtual", ConfigFile: writeTestCore(t, "core.rbf", testCoreData())}
+	port := &cancelOnPoW{VirtualUSBDevice: NewVirtualUSBDevice()}
+	u := NewUSBDiverWithPort(config, port)
+	t.Cleanup(func() { u.Close() })
+	if err := u.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return u, port
+}
+
+func TestVirtualUSBDevicePoWAfterCancel(t *testing.T) {
+	u, port := newTestUSBDiver(t)
+
+	nonce, err := u.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+
+	// the device keeps searching - its response is skipped by the next request
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port.cancel = cancel
+	if nonce, err := u.PoWContext(ctx, testTrytes, 9); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("PoW not cancelled: %s, %v", nonce, err)
+	}
+
+	nonce, err = u.PoW(testTrytes, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNonce(t, testTrytes, nonce, 9)
+	if info := u.Info(); info.Parallel == 0 {
+		t.Errorf("info: %+v", info)
+	}
+}
+
+func TestVirtualUSBDeviceUnknownCommand(t *testing.T) {
+	u, _ := newTestUSBDiver(t)
+
+	// like the firmware the device doesn't answer - the host runs into the timeout
+	com := Com{Cmd: 0x7f, Length: 1}
+	if _, err := u.usbRequest(&com, 300); !errors.Is(err, ErrTimeout) {
+		t.Errorf("unknown command: %v", err)
+	}
+	if _, err := u.fpgaReadStatus(); err != nil {
+		t.Errorf("device doesn't answer after an unknown command: %v", err)
+	}
+}
@@ -1,19 +1,18 @@
 package pidiver
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"reflect"
+	"sync/atomic"
 	"time"
 
 	//	"github.com/iotaledger/iota.go/transaction"
 	"github.com/iotaledger/iota.go/trinary"
 	"github.com/lunixbochs/struc"
+	"github.com/shufps/pidiver/bitstream"
 	serial "github.com/tarm/goserial"
 )
 
@@ -28,6 +27,8 @@ type USBDiver struct {
 	id           uint8
 	VersionMajor uint32
 	VersionMinor uint32
+	parallel     uint32 // reported with the pow results (atomic)
+	core         coreInfo
 }
 
 type Com struct {
@@ -47,6 +48,12 @@ type Meta struct {
 	Filename  [32]rune `struc:"[32]uint8"`
 	Filesize  uint32   `struc:"uint32,little"`
 	AutoConf  uint8    `struc:"uint8"`
+
+	// since META_VERSION 1 - not used by the firmware
+	MetaVersion uint8     `struc:"uint8"`
+	CoreVersion [8]uint8  `struc:"[8]uint8"`
+	SHA256      [32]uint8 `struc:"[32]uint8"`
+	Checksum    uint32    `struc:"uint32,little"` // crc32 of all fields above
 }
 
 type Page struct {
@@ -72,11 +79,16 @@ type Version struct {
 }
 
 func (u *USBDiver) usbRequest(com *Com, timeout int64) (*Com, error) {
+	return u.usbRequestContext(context.Background(), com, timeout)
+}
+
+// write a request with a new id
+func (u *USBDiver) usbSend(com *Com) error {
 	u.id++
 	com.Id = u.id
 
 	if com.Length > MAX_DATA_LENGTH {
-		return &Com{}, errors.New("MAX_DATA_LENGTH exceeded")
+		return fmt.Errorf("%w: MAX_DATA_LENGTH exceeded", ErrProtocol)
 	}
 
 	crc := crc8_messagecalc(com.Data[:], int(com.Length))
@@ -85,35 +97,67 @@ func (u *USBDiver) usbRequest(com *Com, timeout int64) (*Com, error) {
 	var buf bytes.Buffer
 	err := struc.Pack(&buf, com)
 	if err != nil {
-		return &Com{}, errors.New("Error packing struct")
+		return errors.New("Error packing struct")
 	}
 	toWrite := 5 + int(com.Length)
 	written, err := u.port.Write(buf.Bytes()[0:toWrite])
 	//	log.Printf("% X\n", buf.Bytes()[0:toWrite])
 
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceGone, err)
+	}
 	if written != toWrite {
-		return &Com{}, errors.New("Mismatch of written Bytes and Bytes to write")
+		return fmt.Errorf("%w: mismatch of written bytes and bytes to write", ErrProtocol)
+	}
+	return nil
+}
+
+// discard everything the device sends until the line is quiet
+func (u *USBDiver) drain() {
+	response := make([]byte, 128)
+	for {
+		n, err := u.port.Read(response)
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// send request and wait for the response. Responses with another id belong
+// to an earlier (cancelled) request and are skipped.
+//
+// The firmware can't stop a running PoW - when ctx is done the port is drained
+// and the response of the search is skipped by the next request.
+func (u *USBDiver) usbRequestContext(ctx context.Context, com *Com, timeout int64) (*Com, error) {
+	if err := u.usbSend(com); err != nil {
+		return &Com{}, err
 	}
+	id := com.Id
 
 	state := STATE_ID
 	count := uint16(0)
 
 	t := makeTimestamp()
 	for {
+		if ctx.Err() != nil {
+			u.drain()
+			return &Com{}, ErrCancelled
+		}
 		if makeTimestamp()-t > timeout {
-			return &Com{}, errors.New("Read Timeout")
+			return &Com{}, fmt.Errorf("%w: no response from USB device", ErrTimeout)
 		}
 		response := make([]byte, 128)
 		n, err := u.port.Read(response)
-		/*		if err != nil {
-				return &Com{}, errors.New("Error reading USB device")
-			}*/
-		if err != nil || n == 0 {
+		// the serial port returns io.EOF on read timeouts
+		if err != nil && err != io.EOF {
+			return &Com{}, fmt.Errorf("%w: %v", ErrDeviceGone, err)
+		}
+		if n == 0 {
 			time.Sleep(time.Millisecond * 10)
 			continue
 		}
 		if n == 1 && response[0] == 'X' {
-			return &Com{}, errors.New("Protocol Error from USB Device reported")
+			return &Com{}, fmt.Errorf("%w: reported by USB device", ErrProtocol)
 		}
 
 		for i := 0; i < n; i++ {
@@ -138,17 +182,22 @@ func (u *USBDiver) usbRequest(com *Com, timeout int64) (*Com, error) {
 			case STATE_LENGTH_HIGH:
 				com.Length |= uint16(data) << 8
 				if com.Length > MAX_DATA_LENGTH {
-					return &Com{}, errors.New("MAX_DATA_LENGTH exceeded")
+					return &Com{}, fmt.Errorf("%w: MAX_DATA_LENGTH exceeded", ErrProtocol)
 				}
 				state = STATE_DATA
 			case STATE_DATA:
 				com.Data[count] = data
 				count++
 				if count == com.Length {
-					if crc8_messagecalc(com.Data[:], int(com.Length)) == com.Crc8 {
-						return com, nil
+					if crc8_messagecalc(com.Data[:], int(com.Length)) != com.Crc8 {
+						return &Com{}, fmt.Errorf("%w: CRC8 of response", ErrCRC)
+					}
+					if com.Id != id {
+						// stale response of a cancelled request
+						state = STATE_ID
+						continue
 					}
-					return &Com{}, errors.New("CRC8 error")
+					return com, nil
 				}
 			}
 		}
@@ -188,6 +237,42 @@ func (u *USBDiver) GetVersion() string {
 	return fmt.Sprintf("%v.%v", u.VersionMajor, u.VersionMinor)
 }
 
+// Diver interface
+func (u *USBDiver) Init() error {
+	return u.InitUSBDiver()
+}
+
+func (u *USBDiver) PoW(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return u.PowUSBDiver(trytes, minWeight, parallelism...)
+}
+
+func (u *USBDiver) PoWContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	return u.PowUSBDiverContext(ctx, trytes, minWeight)
+}
+
+// the parallel level is known after the first PoW
+func (u *USBDiver) Info() DiverInfo {
+	return DiverInfo{
+		Type:     u.Config.Type,
+		Device:   u.Config.Device,
+		Version:  u.GetVersion(),
+		Parallel: atomic.LoadUint32(&u.parallel),
+		UseCRC:   true,
+
+		Core:       u.core.file,
+		CoreSHA256: u.core.sha256,
+	}
+}
+
+func (u *USBDiver) Close() error {
+	if u.port == nil {
+		return nil
+	}
+	err := u.port.Close()
+	u.port = nil
+	return err
+}
+
 func (u *USBDiver) flashSetPage(page uint32) error {
 	com := Com{Cmd: CMD_SET_PAGE, Length: 4}
 	com.Data[0] = uint8(page & 0x000000ff)
@@ -290,28 +375,30 @@ func (u *USBDiver) fpgaConfigureBlock(data []uint8, l uint16) error {
 	return err
 }
 
-func (u *USBDiver) fpgaConfigureUpload(filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+func (u *USBDiver) progress(phase Phase, total int64) *Progress {
+	return NewProgress(u.Config.OnEvent, u.logger(), u.Config.Device, phase, total)
+}
 
-	stats, statsErr := f.Stat()
-	if statsErr != nil {
-		return err
-	}
+func (u *USBDiver) logger() Logger {
+	return WithFields(ConfigLogger(u.Config), F("device", u.Config.Device))
+}
 
-	var size int = int(stats.Size())
-	if size > FLASH_SIZE {
-		return errors.New("file is too big! >1MB")
-	}
+func (u *USBDiver) log(level Level, msg string, fields ...Field) {
+	u.logger().Log(level, msg, fields...)
+}
 
-	data := make([]byte, size)
-	_, err = bufio.NewReader(f).Read(data)
+func (u *USBDiver) fpgaConfigureUpload(filename string) (err error) {
+	core, err := bitstream.Load(filename, "")
 	if err != nil {
 		return err
 	}
+	u.log(LevelInfo, "uploading core", F("file", filename), F("size", core.Size()), F("sha256", core.Checksum()))
+
+	data := core.Data
+	size := len(data)
+
+	p := u.progress(PhaseConfigure, int64(size))
+	defer func() { p.Done(err) }()
 
 	err = u.fpgaConfigureStart()
 	if err != nil {
@@ -323,91 +410,15 @@ func (u *USBDiver) fpgaConfigureUpload(filename string) error {
 	var offset int
 	for toFlash > 0 {
 		chunk = min(toFlash, 8192)
-		log.Printf("configuring %d%%\n", int(float32(offset)/float32(size)*100))
+		p.Update(int64(offset))
 		err = u.fpgaConfigureBlock(data[offset:offset+chunk], uint16(chunk))
-
-		toFlash -= chunk
-		offset += chunk
-
-	}
-	return nil
-}
-
-func (u *USBDiver) flashUpload(filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	stats, statsErr := f.Stat()
-	if statsErr != nil {
-		return err
-	}
-
-	var size uint32 = uint32(stats.Size())
-	var originalSize uint32 = size
-	if size > FLASH_SIZE {
-		return errors.New("file is too big! >1MB")
-	}
-
-	// extend to page size
-	if size%FLASH_SPI_PAGESIZE != 0 {
-		size += FLASH_SPI_PAGESIZE - size%FLASH_SPI_PAGESIZE
-	}
-
-	data := make([]byte, size)
-	_, err = bufio.NewReader(f).Read(data)
-	if err != nil {
-		return err
-	}
-	log.Printf("erasing flash ...")
-	err = u.flashErase()
-	if err != nil {
-		return err
-	}
-
-	log.Printf("flashing configuration ...")
-	var numPages uint32 = size / FLASH_SPI_PAGESIZE
-	for page := uint32(0); page < numPages; page++ {
-		if page%(numPages/100) == 0 {
-			log.Printf("%d%% flashed ...\n", int(float32(page)/float32(size/FLASH_SPI_PAGESIZE)*100.0))
-		}
-		// TODO?
-		err := u.flashWritePageNumber(page, data[page*FLASH_SPI_PAGESIZE:(page+1)*FLASH_SPI_PAGESIZE])
 		if err != nil {
 			return err
 		}
-	}
-
-	log.Printf("verifying configuration ...")
-	for page := uint32(0); page < size/FLASH_SPI_PAGESIZE; page++ {
-		if page%(numPages/100) == 0 {
-			log.Printf("%d%% veryfied ...\n", int(float32(page)/float32(size/FLASH_SPI_PAGESIZE)*100.0))
-		}
-		var read []uint8
-		read, err = u.flashReadPageNumber(page)
-		if !bytes.Equal(read[:], data[page*FLASH_SPI_PAGESIZE:(page+1)*FLASH_SPI_PAGESIZE]) {
-			return errors.New("verify error at page " + string(page))
-		}
-	}
 
-	var meta Meta
-	meta.Timestamp = uint64(makeTimestamp())
-	copy(meta.Filename[0:31], []rune(filename))
-	meta.Filesize = originalSize
-
-	log.Printf("flashing meta-page ...")
-	err = u.flashWriteMeta(&meta)
-	if err != nil {
-		return err
-	}
-
-	var verifyMeta Meta
-	verifyMeta, err = u.flashReadMeta()
+		toFlash -= chunk
+		offset += chunk
 
-	if !reflect.DeepEqual(meta, verifyMeta) {
-		return errors.New("meta verification failed")
 	}
 	return nil
 }
@@ -417,82 +428,98 @@ func (u *USBDiver) loopTest() error {
 	start := makeTimestamp()
 	_, err := u.usbRequest(&com, 1000)
 	end := makeTimestamp()
-	log.Printf("time %dms\n", (end - start))
-
 	rate := 1.0 / float32(end-start) * 2.0 * 8192.0
-	log.Printf("transfer rate: %.6f\n", rate)
+	u.log(LevelInfo, "loop test", F("time", fmt.Sprintf("%dms", end-start)), F("rate", fmt.Sprintf("%.6f", rate)))
 
 	return err
 }
 
-func (u *USBDiver) InitUSBDiver() error {
-	// baud rate has no effect when using USB-CDC
-	c0 := &serial.Config{Name: u.Config.Device, Baud: 115200, ReadTimeout: time.Millisecond * 500}
+// USBDiver which talks over an already opened port (e.g. a VirtualUSBDevice)
+// instead of opening Config.Device
+func NewUSBDiverWithPort(config *PiDiverConfig, port io.ReadWriteCloser) *USBDiver {
+	return &USBDiver{Config: config, port: port}
+}
 
+// open the port and read the version - doesn't touch fpga or flash
+func (u *USBDiver) Open() error {
 	var err error
-	u.port, err = serial.OpenPort(c0)
-	if err != nil {
-		log.Fatal(err)
+	if u.port == nil {
+		// baud rate has no effect when using USB-CDC
+		c0 := &serial.Config{Name: u.Config.Device, Baud: 115200, ReadTimeout: time.Millisecond * 500}
+
+		u.port, err = serial.OpenPort(c0)
+		if err != nil {
+			return &DeviceError{Device: u.Config.Device, Op: "open", Err: fmt.Errorf("%w: %v", ErrDeviceGone, err)}
+		}
 	}
 
 	version, err := u.usbGetVersion()
 	if err != nil {
-		return err
+		return &DeviceError{Device: u.Config.Device, Op: "open", Err: err}
 	}
 	u.VersionMajor = version.Major
 	u.VersionMinor = version.Minor
 
-	log.Printf("USBDiver version: %v.%v\n", u.VersionMajor, u.VersionMinor)
+	u.log(LevelInfo, "USBDiver opened", F("version", u.GetVersion()))
+	return nil
+}
 
-	var status Status
-	status, err = u.fpgaReadStatus()
-	if err != nil {
+// boards since version 1.1 configure the fpga from the spi flash
+func (u *USBDiver) HasFlash() bool {
+	return u.VersionMajor == 1 && u.VersionMinor == 1
+}
+
+func (u *USBDiver) InitUSBDiver() error {
+	if err := u.Open(); err != nil {
 		return err
 	}
 
-	if true /*version.Major == 1 && version.Minor == 0*/ {
+	status, err := u.fpgaReadStatus()
+	if err != nil {
+		return &DeviceError{Device: u.Config.Device, Op: "init", Err: err}
+	}
+
+	if !u.HasFlash() {
 		// doesn't have flash
 		if u.Config.ForceConfigure || status.IsFPGAConfigured == 0 {
-			log.Printf("fpga not configured (or configuring forced). configuring ... (10-40sec)")
+			u.log(LevelInfo, "fpga not configured (or configuring forced). configuring ... (10-40sec)")
 			err = u.fpgaConfigureUpload(u.Config.ConfigFile)
 			if err != nil {
-				log.Fatal("error configuring fpga")
+				return &DeviceError{Device: u.Config.Device, Op: "configure", Err: err}
 			}
 
 		}
-	} /* else if version.Major == 1 && version.Minor == 1 {
-		var meta Meta
-		meta, err = flashReadMeta()
-		if config.ForceFlash || meta.Timestamp == 0xffffffffffffffff {
-			log.Printf("flash is empty (or flashing is forced\n")
-			err := flashUpload(config.ConfigFile)
-			if err != nil {
-				log.Fatalf("error flashing file %s\n", config.ConfigFile)
-			} else {
-				log.Printf("flashing was successful!")
-			}
-		} else {
-			log.Printf("configuration in flash found:\n")
-			log.Printf("Timestamp: %d\n", meta.Timestamp)
-			log.Printf("Filename: %s\n", string(meta.Filename[:]))
-			log.Printf("Filesize: %d\n", meta.Filesize)
+	} else {
+		if err := u.FlashUpdate(u.Config.ConfigFile, u.Config.ForceFlash); err != nil {
+			return &DeviceError{Device: u.Config.Device, Op: "flash", Err: err}
 		}
 
-		if config.ForceConfigure || status.IsFPGAConfigured == 0 {
-			log.Printf("fpga not configured (or configuring forced). configuring ... (10-40sec)")
-			err = fpgaConfigure()
+		if u.Config.ForceConfigure || status.IsFPGAConfigured == 0 {
+			u.log(LevelInfo, "fpga not configured (or configuring forced). configuring from flash ...")
+			err = u.ConfigureFromFlash()
 			if err != nil {
-				log.Fatal("error configuring fpga")
+				return &DeviceError{Device: u.Config.Device, Op: "configure", Err: err}
 			}
 		}
-	}*/
+	}
 
 	status, err = u.fpgaReadStatus()
-
+	if err != nil {
+		return &DeviceError{Device: u.Config.Device, Op: "init", Err: err}
+	}
 	if status.IsFPGAConfigured == 0 {
-		log.Fatal("fpga not configured!")
+		return &DeviceError{Device: u.Config.Device, Op: "init", Err: ErrNotConfigured}
+	}
+
+	if u.HasFlash() {
+		// the fpga is configured from the flash
+		if meta, err := u.flashReadMeta(); err == nil && meta.Verify() == nil {
+			u.core = coreInfo{file: meta.FilenameString(), sha256: meta.SHA256String()}
+		}
+	} else {
+		u.core = readCoreInfo(u.Config.ConfigFile)
 	}
-	log.Printf("ready for PoW")
+	u.log(LevelInfo, "ready for PoW")
 
 	initTryteMap()
 
@@ -501,8 +528,24 @@ func (u *USBDiver) InitUSBDiver() error {
 
 // do PoW
 func (u *USBDiver) PowUSBDiver(trytes trinary.Trytes, minWeight int, parallelism ...int) (trinary.Trytes, error) {
+	return u.PowUSBDiverContext(context.Background(), trytes, minWeight)
+}
+
+// do PoW - stops waiting for the device when ctx is done
+func (u *USBDiver) PowUSBDiverContext(ctx context.Context, trytes trinary.Trytes, minWeight int) (trinary.Trytes, error) {
+	report, err := u.PoWWithReport(ctx, trytes, minWeight)
+	if err != nil {
+		return "", err
+	}
+	return report.Nonce, nil
+}
+
+// do PoW and return the nonce with diagnostics - the midstate is calculated by
+// the device, so Search is the time measured by the device
+func (u *USBDiver) PoWWithReport(ctx context.Context, trytes trinary.Trytes, minWeight int) (*PoWReport, error) {
 	// do mid-state-calculation on FPGA
 	//	var start int64 = makeTimestamp()
+	start := time.Now()
 
 	com := Com{Cmd: CMD_DO_POW}
 
@@ -515,23 +558,44 @@ func (u *USBDiver) PowUSBDiver(trytes trinary.Trytes, minWeight int, parallelism
 	var tmpBuffer bytes.Buffer
 	err := struc.Pack(&tmpBuffer, &data)
 	if err != nil {
-		return trinary.Trytes(""), err
+		return nil, err
 	}
 	copy(com.Data[0:], tmpBuffer.Bytes())
 
-	com.Length = 3700                  // (891 + 33 + 1) * 4
-	_, err = u.usbRequest(&com, 10000) // 10sec enough?
+	// midstate is calculated by the device
+	p := u.progress(PhasePoW, 0)
+	com.Length = 3700                              // (891 + 33 + 1) * 4
+	_, err = u.usbRequestContext(ctx, &com, 10000) // 10sec enough?
 	if err != nil {
-		return trinary.Trytes(""), err
+		p.Done(err)
+		return nil, err
 	}
 
 	var powResult PoWResult
 	if err := struc.Unpack(bytes.NewReader(com.Data[0:com.Length]), &powResult); err != nil {
-		return trinary.Trytes(""), errors.New("error unpack pow results")
+		err = fmt.Errorf("%w: error unpack pow results", ErrProtocol)
+		p.Done(err)
+		return nil, err
 	}
+	p.SetHashes(uint64(powResult.Nonce) * uint64(powResult.Parallel))
+	p.Done(nil)
+	atomic.StoreUint32(&u.parallel, powResult.Parallel)
 
-	log.Printf("Found nonce: %08x (mask: %08x)\n", powResult.Nonce, powResult.Mask)
-	log.Printf("PoW-Time: %dms (%.2fMH/s)\n", powResult.Time, 1.0/(float32(powResult.Time+1)/1000.0)*float32(powResult.Nonce*powResult.Parallel)/1000000.0)
+	u.log(LevelDebug, "found nonce", F("nonce", fmt.Sprintf("%08x", powResult.Nonce)), F("mask", fmt.Sprintf("%08x", powResult.Mask)))
+	u.log(LevelDebug, "pow done", F("time", fmt.Sprintf("%dms", powResult.Time)),
+		F("rate", fmt.Sprintf("%.2fMH/s", 1.0/(float32(powResult.Time+1)/1000.0)*float32(powResult.Nonce*powResult.Parallel)/1000000.0)))
 
-	return assembleNonce(powResult.Nonce, powResult.Mask, powResult.Parallel)
+	nonce, err := assembleNonce(powResult.Nonce, powResult.Mask, powResult.Parallel)
+	if err != nil {
+		return nil, err
+	}
+	report := newReport(u.Info(), minWeight)
+	report.Nonce = nonce
+	report.Search = msDuration(int64(powResult.Time))
+	report.Total = time.Since(start)
+	report.Counter = powResult.Nonce
+	report.Mask = powResult.Mask
+	report.Parallel = powResult.Parallel
+	report.Hashes = uint64(powResult.Nonce) * uint64(powResult.Parallel)
+	return report, nil
 }
@@ -1,25 +1,20 @@
 package raspberry
 
 import (
-	"bufio"
 	"encoding/binary"
-	"errors"
-	"log"
-	"os"
+	"fmt"
 	"time"
 
+	"github.com/shufps/pidiver/fpga"
 	"github.com/shufps/pidiver/pidiver"
 
 	"github.com/shufps/bcm2835"
 )
 
 const (
-	SPI_CS        = 5
-	GPIO_nCONFIG  = 2
-	GPIO_DATA0    = 3
-	GPIO_DCK      = 4
-	GPIO_nSTATUS  = 17
-	GPIO_CONFDONE = 7
+	DEFAULT_BOARD = "raspberry"
+
+	BCM2835_CORE_CLOCK = 250000000
 
 	BCM2835_SPI_BIT_ORDER_LSBFIRST = 0 ///< LSB First
 	BCM2835_SPI_BIT_ORDER_MSBFIRST = 1 ///< MSB First
@@ -54,19 +49,38 @@ const (
 )
 
 func init() {
+	pidiver.RegisterDiver("pidiver", func(config *pidiver.PiDiverConfig) (pidiver.Diver, error) {
+		return &pidiver.PiDiver{LLStruct: GetLowLevel(), Config: config}, nil
+	})
 }
 
 func GetLowLevel() pidiver.LLStruct {
-	return pidiver.LLStruct{LLInit: llInit, LLSPISend: send, LLSPISendBlock: sendBlock, LLSPISendReceive: sendReceive}
+	return pidiver.LLStruct{LLInit: llInit, LLSPISend: send, LLSPISendBlock: sendBlock, LLSPISendReceive: sendReceive, LLClose: llClose}
+}
+
+// profile loaded by llInit
+var board *pidiver.BoardProfile
+
+// chip select as gpio - nothing to do with hardware chip select
+func csClr() {
+	if board.CS >= 0 {
+		bcm2835.GpioClr(board.CS)
+	}
+}
+
+func csSet() {
+	if board.CS >= 0 {
+		bcm2835.GpioSet(board.CS)
+	}
 }
 
 // send command
 func send(data uint32) error {
 	var bytedata []byte = make([]byte, 4)
 	binary.BigEndian.PutUint32(bytedata, data)
-	bcm2835.GpioClr(SPI_CS)
+	csClr()
 	bcm2835.SpiTransfern(bytedata)
-	bcm2835.GpioSet(SPI_CS)
+	csSet()
 	return nil
 }
 
@@ -84,124 +98,97 @@ func sendReceive(cmd uint32) (uint32, error) {
 	bytedata_read := make([]byte, 4)
 	binary.BigEndian.PutUint32(bytedata, cmd)
 
-	bcm2835.GpioClr(SPI_CS)
+	csClr()
 	bcm2835.SpiTransfern(bytedata)
-	bcm2835.GpioSet(SPI_CS)
-	bcm2835.GpioClr(SPI_CS)
+	csSet()
+	csClr()
 	bcm2835.SpiTransfernb(bytedata_read, bytedata_read)
-	bcm2835.GpioSet(SPI_CS)
+	csSet()
 	return binary.BigEndian.Uint32(bytedata_read), nil
 }
 
-func configureFPGA(filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	stats, statsErr := f.Stat()
-	if statsErr != nil {
-		return err
-	}
-
-	size := stats.Size()
-	data := make([]byte, size)
-	_, err = bufio.NewReader(f).Read(data)
-	if err != nil {
-		return err
-	}
+// bcm2835 as GPIO for the fpga configurator
+type bcm2835GPIO struct{}
 
-	log.Printf("bytes read: %d\n", size)
-	bcm2835.GpioClr(GPIO_DCK)
+func (bcm2835GPIO) Input(pin int) error {
+	bcm2835.GpioFsel(pin, bcm2835.Input)
+	return nil
+}
 
-	/* pulling FPGA_CONFIG to low resets the FPGA */
-	bcm2835.GpioClr(GPIO_nCONFIG)     /* FPGA config => low */
-	time.Sleep(time.Millisecond * 10) /* give it some time to do its reset stuff */
+func (bcm2835GPIO) Output(pin int, high bool) error {
+	bcm2835GPIO{}.Set(pin, high)
+	bcm2835.GpioFsel(pin, bcm2835.Output)
+	return nil
+}
 
-	for {
-		if (bcm2835.GpioLev(GPIO_nSTATUS) != 0) && (bcm2835.GpioLev(GPIO_CONFDONE) != 0) {
-			continue
-		}
-		break
+func (bcm2835GPIO) Set(pin int, high bool) error {
+	if high {
+		bcm2835.GpioSet(pin)
+	} else {
+		bcm2835.GpioClr(pin)
 	}
+	return nil
+}
 
-	bcm2835.GpioSet(GPIO_nCONFIG)
-	for {
-		if bcm2835.GpioLev(GPIO_nSTATUS) == 0 {
-			continue
-		}
-		break
-	}
+func (bcm2835GPIO) Get(pin int) (bool, error) {
+	return bcm2835.GpioLev(pin) != 0, nil
+}
 
-	index := int64(0)
-	log.Printf("configuring ...")
-	for {
-		//              log.Printf("index %d\n", index)
-		var value uint8 = data[index]
-		index++
-		for i := uint8(0); i < 8; i++ {
-			if (value>>i)&0x1 != 0 {
-				bcm2835.GpioSet(GPIO_DATA0)
-			} else {
-				bcm2835.GpioClr(GPIO_DATA0)
-			}
-			bcm2835.GpioSet(GPIO_DCK)
-			bcm2835.GpioClr(GPIO_DCK)
-		}
-		if bcm2835.GpioLev(GPIO_CONFDONE) == 0 && index < size {
-			continue
-		}
-		break
+// smallest power of two divider for a clock not faster than hz
+func clockDivider(hz int) uint16 {
+	divider := uint16(2)
+	for BCM2835_CORE_CLOCK/int(divider) > hz && divider < 32768 {
+		divider *= 2
 	}
-	log.Printf("configure done")
-
-	return nil
+	return divider
 }
 
 func llInit(config *pidiver.PiDiverConfig) error {
-	err := bcm2835.Init() // Initialize the library
+	var err error
+	board, err = pidiver.ConfigBoard(config, DEFAULT_BOARD)
 	if err != nil {
-		return errors.New("Couldn't initialize BCM2835 Lib")
+		return err
 	}
 
-	// configure pins for configuring
-	bcm2835.GpioFsel(GPIO_CONFDONE, bcm2835.Input)
-
-	if config.ForceConfigure || bcm2835.GpioLev(GPIO_CONFDONE) == 0 {
-		bcm2835.GpioClr(GPIO_DCK)
-		bcm2835.GpioSet(GPIO_nCONFIG)
-		bcm2835.GpioFsel(GPIO_DATA0, bcm2835.Output)
-		bcm2835.GpioFsel(GPIO_DCK, bcm2835.Output)
-		bcm2835.GpioFsel(GPIO_nCONFIG, bcm2835.Output)
-		bcm2835.GpioFsel(GPIO_nSTATUS, bcm2835.Input)
-
-		log.Printf("fpga not configured (or force selected ... configuring ...")
-		err := configureFPGA(config.ConfigFile)
-		if err != nil {
-			return err
-		}
+	err = bcm2835.Init() // Initialize the library
+	if err != nil {
+		return fmt.Errorf("%w: couldn't initialize BCM2835 lib: %v", pidiver.ErrDeviceGone, err)
 	}
 
-	if bcm2835.GpioLev(GPIO_CONFDONE) == 0 {
-		return errors.New("error configuring!")
+	// configure fpga if needed
+	if err := fpga.InitBoard(bcm2835GPIO{}, board, config); err != nil {
+		return err
 	}
 
 	/* init spi interface */
 	bcm2835.SpiBegin()
-	bcm2835.SpiSetBitOrder(BCM2835_SPI_BIT_ORDER_MSBFIRST) /* default */
-	bcm2835.SpiSetDataMode(BCM2835_SPI_MODE0)              /* default */
-	bcm2835.SpiSetClockDivider(BCM2835_SPI_CLOCK_DIVIDER_32)
+	if board.LSBFirst() {
+		bcm2835.SpiSetBitOrder(BCM2835_SPI_BIT_ORDER_LSBFIRST)
+	} else {
+		bcm2835.SpiSetBitOrder(BCM2835_SPI_BIT_ORDER_MSBFIRST)
+	}
+	bcm2835.SpiSetDataMode(board.SPIMode)
+	bcm2835.SpiSetClockDivider(clockDivider(board.SPIClock))
+
+	if board.CS < 0 {
+		bcm2835.SpiChipSelect(board.SPIChipSelect)
+		return nil
+	}
 	bcm2835.SpiChipSelect(BCM2835_SPI_CS_NONE) /* default */
 
-	bcm2835.GpioFsel(SPI_CS, bcm2835.Output)
+	bcm2835.GpioFsel(board.CS, bcm2835.Output)
 
-	bcm2835.GpioSet(SPI_CS)
+	bcm2835.GpioSet(board.CS)
 	time.Sleep(10 * time.Millisecond)
-	bcm2835.GpioClr(SPI_CS)
+	bcm2835.GpioClr(board.CS)
 	time.Sleep(10 * time.Millisecond)
-	bcm2835.GpioSet(SPI_CS)
+	bcm2835.GpioSet(board.CS)
 	time.Sleep(10 * time.Millisecond)
 
 	return nil
 }
+
+func llClose() error {
+	bcm2835.SpiEnd()
+	return bcm2835.Close()
+}
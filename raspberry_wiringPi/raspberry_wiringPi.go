@@ -9,11 +9,10 @@ package raspberry_wiringPi
 	
 // wiringPi Numbers
 #define	SPI_CS         21
-#define	GPIO_nCONFIG   8
-#define	GPIO_DATA0     9
-#define	GPIO_DCK       7
-#define	GPIO_nSTATUS   0
-#define	GPIO_CONFDONE  11
+
+// set from the board profile
+int spi_cs = SPI_CS;
+int spi_channel = 0;
 
 uint32_t swap(uint32_t x) {
 	return ((x & 0xff000000) >> 24) |
@@ -22,11 +21,19 @@ uint32_t swap(uint32_t x) {
 		((x & 0x000000ff) << 24);
 }
 
+void csClr() {
+	if (spi_cs >= 0) digitalWrite(spi_cs, 0);
+}
+
+void csSet() {
+	if (spi_cs >= 0) digitalWrite(spi_cs, 1);
+}
+
 void send(uint32_t data) {
 	uint32_t bytedata = swap(data);
-	digitalWrite(SPI_CS, 0);
-	wiringPiSPIDataRW(0, (char*) &bytedata, 4);
-	digitalWrite(SPI_CS, 1);
+	csClr();
+	wiringPiSPIDataRW(spi_channel, (char*) &bytedata, 4);
+	csSet();
 }
 
 uint32_t sendBlock(uint32_t* data, int len) {
@@ -39,13 +46,13 @@ uint32_t sendReceive(uint32_t data) {
 	uint32_t bytedata = swap(data);
 	uint32_t bytedata_read = 0;
 
-	digitalWrite(SPI_CS, 0);
-	wiringPiSPIDataRW(0, (char*) &bytedata, 4);
-	digitalWrite(SPI_CS, 1);
+	csClr();
+	wiringPiSPIDataRW(spi_channel, (char*) &bytedata, 4);
+	csSet();
 
-	digitalWrite(SPI_CS, 0);
-	wiringPiSPIDataRW(0, (char*) &bytedata_read, 4);
-	digitalWrite(SPI_CS, 1);
+	csClr();
+	wiringPiSPIDataRW(spi_channel, (char*) &bytedata_read, 4);
+	csSet();
 
 	return swap(bytedata_read);
 }
@@ -55,28 +62,24 @@ import "C"
 
 
 import (
-	"bufio"
 	"errors"
+	"fmt"
 	"unsafe"
-	"log"
-	"os"
 	"time"
 
+	"github.com/shufps/pidiver/fpga"
 	"github.com/shufps/pidiver/pidiver"
 
 )
 
 const (
-	// wiringPi Numbers
-	SPI_CS        = 21
-	GPIO_nCONFIG  = 8
-	GPIO_DATA0    = 9
-	GPIO_DCK      = 7
-	GPIO_nSTATUS  = 0
-	GPIO_CONFDONE = 11
+	DEFAULT_BOARD = "raspberry_wiringpi"
 )
 
 func init() {
+	pidiver.RegisterDiver("pidiver_wp", func(config *pidiver.PiDiverConfig) (pidiver.Diver, error) {
+		return &pidiver.PiDiver{LLStruct: GetLowLevel(), Config: config}, nil
+	})
 }
 
 func GetLowLevel() pidiver.LLStruct {
@@ -121,116 +124,73 @@ func gpioFsel(pin int, mode int) {
 func initWiringPi() error {
 	ret := int(C.wiringPiSetup())
 	if ret == -1 {
-		return errors.New("error init wiringpi")
+		return fmt.Errorf("%w: error init wiringpi", pidiver.ErrDeviceGone)
 	}
 	return nil
 }
 
-func configureFPGA(filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	stats, statsErr := f.Stat()
-	if statsErr != nil {
-		return err
-	}
-
-	size := stats.Size()
-	data := make([]byte, size)
-	_, err = bufio.NewReader(f).Read(data)
-	if err != nil {
-		return err
-	}
-
-	log.Printf("bytes read: %d\n", size)
-	gpioClr(GPIO_DCK)
+// wiringPi as GPIO for the fpga configurator
+type wiringPiGPIO struct{}
 
-	/* pulling FPGA_CONFIG to low resets the FPGA */
-	gpioClr(GPIO_nCONFIG)	/* FPGA config => low */
-	time.Sleep(time.Millisecond * 10) /* give it some time to do its reset stuff */
-
-	for {
-		if (gpioLev(GPIO_nSTATUS) != 0) && (gpioLev(GPIO_CONFDONE) != 0) {
-			continue
-		}
-		break
-	}
+func (wiringPiGPIO) Input(pin int) error {
+	gpioFsel(pin, 0)
+	return nil
+}
 
-	gpioSet(GPIO_nCONFIG)
-	for {
-		if gpioLev(GPIO_nSTATUS) == 0 {
-			continue
-		}
-		break
-	}
+func (wiringPiGPIO) Output(pin int, high bool) error {
+	wiringPiGPIO{}.Set(pin, high)
+	gpioFsel(pin, 1)
+	return nil
+}
 
-	index := int64(0)
-	log.Printf("configuring ...")
-	for {
-		//              log.Printf("index %d\n", index)
-		var value uint8 = data[index]
-		index++
-		for i := uint8(0); i < 8; i++ {
-			if (value>>i)&0x1 != 0 {
-				gpioSet(GPIO_DATA0)
-			} else {
-				gpioClr(GPIO_DATA0)
-			}
-			gpioSet(GPIO_DCK)
-			gpioClr(GPIO_DCK)
-		}
-		if gpioLev(GPIO_CONFDONE) == 0 && index < size {
-			continue
-		}
-		break
+func (wiringPiGPIO) Set(pin int, high bool) error {
+	if high {
+		gpioSet(pin)
+	} else {
+		gpioClr(pin)
 	}
-	log.Printf("configure done")
-
 	return nil
 }
 
+func (wiringPiGPIO) Get(pin int) (bool, error) {
+	return gpioLev(pin) != 0, nil
+}
+
 func llInit(config *pidiver.PiDiverConfig) error {
-	err := initWiringPi()
+	board, err := pidiver.ConfigBoard(config, DEFAULT_BOARD)
 	if err != nil {
 		return err
 	}
+	if board.SPIMode != 0 || board.LSBFirst() {
+		return errors.New("wiringPi only supports spi mode 0 and msb first")
+	}
 
-	log.Printf("Using WiringPi")
-	// configure pins for configuring
-	gpioFsel(GPIO_CONFDONE, 0)
-
-	if config.ForceConfigure || gpioLev(GPIO_CONFDONE) == 0 {
-		gpioClr(GPIO_DCK)
-		gpioSet(GPIO_nCONFIG)
-		gpioFsel(GPIO_DATA0, 1)
-		gpioFsel(GPIO_DCK, 1)
-		gpioFsel(GPIO_nCONFIG, 1)
-		gpioFsel(GPIO_nSTATUS, 0)
-
-		log.Printf("fpga not configured (or force selected ... configuring ...")
-		err := configureFPGA(config.ConfigFile)
-		if err != nil {
-			return err
-		}
+	err = initWiringPi()
+	if err != nil {
+		return err
 	}
 
-	if gpioLev(GPIO_CONFDONE) == 0 {
-		return errors.New("error configuring!")
+	pidiver.ConfigLogger(config).Log(pidiver.LevelInfo, "using WiringPi")
+	// configure fpga if needed
+	if err := fpga.InitBoard(wiringPiGPIO{}, board, config); err != nil {
+		return err
 	}
 
 	/* init spi interface */
-	C.wiringPiSPISetup (C.int(0), C.int(10000000))
+	C.spi_cs = C.int(board.CS)
+	C.spi_channel = C.int(board.SPIChipSelect)
+	C.wiringPiSPISetup (C.int(board.SPIChipSelect), C.int(board.SPIClock))
 
-	gpioFsel(SPI_CS, 1)
+	if board.CS < 0 {
+		return nil
+	}
+	gpioFsel(board.CS, 1)
 
-	gpioSet(SPI_CS)
+	gpioSet(board.CS)
 	time.Sleep(10 * time.Millisecond)
-	gpioClr(SPI_CS)
+	gpioClr(board.CS)
 	time.Sleep(10 * time.Millisecond)
-	gpioSet(SPI_CS)
+	gpioSet(board.CS)
 	time.Sleep(10 * time.Millisecond)
 
 	return nil
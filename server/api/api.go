@@ -2,13 +2,13 @@ package api
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/iotaledger/iota.go/pow"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/shufps/pidiver/pidiver"
 	"github.com/shufps/pidiver/server/config"
 	"github.com/shufps/pidiver/server/logs"
 )
@@ -31,6 +31,9 @@ type Request struct {
 	TrunkTransaction   string
 	BranchTransaction  string
 	MinWeightMagnitude int
+	CancelToken        string // interruptAttachingToTangle with this token cancels the request
+	// for attach jobs
+	JobId string
 }
 
 var (
@@ -41,13 +44,16 @@ var (
 	limitAccess  []string
 )
 
-var powFuncs []pow.ProofOfWorkFunc
+var pool *pidiver.DiverPool
 
-func SetPowFuncs(funcs []pow.ProofOfWorkFunc) {
-	powFuncs = funcs
+func SetDiverPool(p *pidiver.DiverPool) {
+	pool = p
+	pool.OnWait = observeQueueWait
+	logs.Log.Infof("[PoW] Using PiDiver (%d devices)", pool.Size())
 }
 
 func Start() {
+	startTime = time.Now()
 
 	api.Use(gin.Recovery())
 	gin.SetMode(gin.ReleaseMode)
@@ -55,6 +61,12 @@ func Start() {
 	configureLimitAccess()
 	configureAPIUserAuthentication()
 	configureCORSMiddleware()
+	configureAPIKeys()
+	configureMetrics()
+	configureProxy()
+	startAttach()
+	startJobs()
+	configureRateLimits()
 
 	createAPIEndpoint("", mainAPICalls)
 
@@ -72,8 +84,6 @@ func Start() {
 	if useHTTPS {
 		go serveHttps(api)
 	}
-
-	startAttach()
 }
 
 func configureAPIUserAuthentication() {
@@ -86,13 +96,17 @@ func configureAPIUserAuthentication() {
 
 func configureCORSMiddleware() {
 	setAllowOriginToAll := config.AppConfig.GetBool("api.cors.setAllowOriginToAll")
+	allowHeaders := "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-IOTA-API-Version"
+	if config.AppConfig.GetString("api.keys.file") != "" {
+		allowHeaders += ", " + config.AppConfig.GetString("api.keys.header")
+	}
 
 	corsMiddleware := func(c *gin.Context) {
 		if setAllowOriginToAll {
 			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		}
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-IOTA-API-Version")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", allowHeaders)
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
 
 		if c.Request.Method == "OPTIONS" {
@@ -132,12 +146,15 @@ func serveHttp(api *gin.Engine) {
 }
 
 func End() {
+	stopProxy()
+	jobs.cancelAll()
+	stopRateLimits()
 	if srv != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 		if err := srv.Shutdown(ctx); err != nil {
 			logs.Log.Error("API server Shutdown Error:", err)
 		} else {
-			cancel()
 			logs.Log.Debug("API server exited")
 		}
 	}
@@ -160,9 +177,11 @@ func createAPIEndpoint(endpointPath string, endpointImplementation map[string]AP
 		ts := time.Now()
 
 		var request Request
-		err := c.ShouldBindJSON(&request)
+		// keeps the body for the proxy
+		err := c.ShouldBindBodyWith(&request, binding.JSON)
 		if err == nil {
 			caseInsensitiveCommand := strings.ToLower(request.Command)
+			logs.Log.Infof("Request %v from remote %v (key %s)", request.Command, c.Request.RemoteAddr, requestKeyName(c))
 			if triesToAccessLimited(caseInsensitiveCommand, c) {
 				logs.Log.Infof("Denying limited command request %v from remote %v", request.Command, c.Request.RemoteAddr)
 				replyError("Limited remote command access", c)
@@ -173,10 +192,19 @@ func createAPIEndpoint(endpointPath string, endpointImplementation map[string]AP
 			if apiCallExists {
 				implementation(request, c, ts)
 			} else {
-				logs.Log.Info("Redirecting", request.Command)
-				node := fmt.Sprintf("%s:%s", config.AppConfig.GetString("api.http.node"), config.AppConfig.GetString("api.http.port"))
-				// c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf("http://%s:%s", config.AppConfig.GetString("api.http.node"), config.AppConfig.GetString("api.http.port")))
-				c.Redirect(http.StatusPermanentRedirect, node)
+				if !requestHasRole(c, RoleProxy) {
+					logs.Log.Infof("Denying proxied command request %v from remote %v (key %s)", request.Command, c.Request.RemoteAddr, requestKeyName(c))
+					replyError("Command not allowed for API key", c)
+					return
+				}
+				if !proxy.allowed(caseInsensitiveCommand) {
+					logs.Log.Infof("Denying proxied command request %v from remote %v", request.Command, c.Request.RemoteAddr)
+					replyError("Command not available", c)
+					return
+				}
+				logs.Log.Debug("Proxying", request.Command)
+				body, _ := c.Get(gin.BodyBytesKey)
+				proxy.forward(c, body.([]byte))
 				return
 			}
 
@@ -209,6 +237,9 @@ func triesToAccessLimited(caseInsensitiveCommand string, c *gin.Context) bool {
 	if c.Request.RemoteAddr[:9] == "127.0.0.1" {
 		return false
 	}
+	if apiKeys != nil && requestHasRole(c, RoleAdmin) {
+		return false
+	}
 	for _, caseInsensitiveLimitAccessEntry := range limitAccess {
 		if caseInsensitiveLimitAccessEntry == caseInsensitiveCommand {
 			return true
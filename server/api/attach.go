@@ -3,9 +3,11 @@ package api
 // complaints or suggestions pls to pmaxuw on discord
 
 import (
+	"context"
 	"errors"
+	"net"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
 	//    "github.com/spf13/viper"
@@ -13,8 +15,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/iotaledger/iota.go/consts"
 	"github.com/iotaledger/iota.go/curl"
-	"github.com/iotaledger/iota.go/pow"
 	"github.com/iotaledger/iota.go/trinary"
+	"github.com/shufps/pidiver/pidiver"
 	"github.com/shufps/pidiver/server/config"
 	"github.com/shufps/pidiver/server/logs"
 )
@@ -37,15 +39,13 @@ const (
 )
 
 var (
-	powLock                 = &sync.Mutex{}
-	maxMinWeightMagnitude   = 0
-	maxTransactions         = 0
-	useDiverDriver          = false
-	interruptAttachToTangle = false
-	powInitialized          = false
-	powType                 string
-	powVersion              string
-	serverVersion           string
+	maxMinWeightMagnitude = 0
+	maxTransactions       = 0
+	useDiverDriver        = false
+	powInitialized        = false
+	powType               string
+	powVersion            string
+	serverVersion         string
 )
 
 // Int2Trits converts int64 to trits.
@@ -112,74 +112,141 @@ func toRunes(t trinary.Trytes) []rune {
 	return []rune(string(t))
 }
 
-// interrupts not PoW itselfe (no PoW of giota support interrupts) but stops
-// attatchToTangle after the last transaction PoWed
+// stops the attatchToTangle calls and jobs of the caller and the PoWs on the
+// devices - the ones started with the same cancelToken or, without token, the
+// ones started from the same address
 func interruptAttachingToTangle(request Request, c *gin.Context, t time.Time) {
-	interruptAttachToTangle = true
-	c.JSON(http.StatusOK, gin.H{})
+	owner := requestOwner(c)
+	cancelled := jobs.cancelWhere(func(job *attachJob) bool {
+		if request.CancelToken != "" {
+			return job.token == request.CancelToken
+		}
+		return job.owner == owner
+	})
+	logs.Log.Debugf("Interrupted %d attach jobs of %s", cancelled, owner)
+	c.JSON(http.StatusOK, gin.H{
+		"duration": getDuration(t),
+	})
+}
+
+// api key or address of the client (without port) - jobs can only be interrupted by their owner
+func requestOwner(c *gin.Context) string {
+	if key := requestKey(c); key != nil {
+		return "key " + key.Name
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
 }
 
 func getTimestamp() int64 {
 	return time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond)) // time.Nanosecond should always be 1 ... but if not ...^^
 }
 
-// attachToTangle
-// do everything with trytes and save time by not convertig to trits and back
-// all constants have to be divided by 3
+// attachToTangle - a job which is waited for. It is cancelled when the client disconnects
 func attachToTangle(request Request, c *gin.Context, t time.Time) {
-	// only one attatchToTangle allowed in parallel
-	powLock.Lock()
-	defer powLock.Unlock()
+	job, err := newAttachJob(c.Request.Context(), request, c)
+	if err != nil {
+		rejectAttach(err, c)
+		return
+	}
+	jobs.add(job)
+	defer jobs.remove(job.id)
 
-	interruptAttachToTangle = false
+	// attatchToTangle calls run in parallel - the pool hands every
+	// transaction to the next idle device
+	job.run()
 
-	var returnTrytes []string
+	status := job.status()
+	if status.Status != JobDone.String() {
+		replyError(status.Error, c)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"trytes": job.result(),
+	})
+}
 
+// validate the request before doing PoW - the job is cancelled with ctx
+func newAttachJob(ctx context.Context, request Request, c *gin.Context) (*attachJob, error) {
 	trunkTransaction, err := toRunesCheckTrytes(request.TrunkTransaction, consts.TrunkTransactionTrinarySize/3)
 	if err != nil {
-		replyError("Invalid trunkTransaction-Trytes", c)
-		return
+		return nil, errors.New("Invalid trunkTransaction-Trytes")
 	}
 
 	branchTransaction, err := toRunesCheckTrytes(request.BranchTransaction, consts.BranchTransactionTrinarySize/3)
 	if err != nil {
-		replyError("Invalid branchTransaction-Trytes", c)
-		return
+		return nil, errors.New("Invalid branchTransaction-Trytes")
 	}
 
 	minWeightMagnitude := request.MinWeightMagnitude
+	maxMWM, maxTx := requestLimits(c)
 
 	// restrict minWeightMagnitude
-	if minWeightMagnitude > maxMinWeightMagnitude {
-		replyError("MinWeightMagnitude too high", c)
-		return
+	if minWeightMagnitude > maxMWM {
+		return nil, errors.New("MinWeightMagnitude too high")
 	}
 
 	trytes := request.Trytes
 
 	// limit number of transactions in a bundle
-	if len(trytes) > maxTransactions {
-		replyError("Too many transactions", c)
-		return
+	if len(trytes) > maxTx {
+		return nil, errors.New("Too many transactions")
 	}
-	returnTrytes = make([]string, len(trytes))
 	inputRunes := make([][]rune, len(trytes))
 
 	// validate input trytes before doing PoW
 	for idx, tryte := range trytes {
 		if runes, err := toRunesCheckTrytes(tryte, consts.TransactionTrinarySize/3); err != nil {
-			replyError("Error in Tryte input", c)
-			return
+			return nil, errors.New("Error in Tryte input")
 		} else {
 			inputRunes[idx] = runes
 		}
 	}
 
+	owner := requestOwner(c)
+	release, err := limiter.admit(owner, requestKey(c), len(inputRunes), minWeightMagnitude)
+	if err != nil {
+		logs.Log.Infof("Limiting %s: %v", owner, err)
+		return nil, err
+	}
+
+	job := newJob(ctx, trunkTransaction, branchTransaction, minWeightMagnitude, inputRunes)
+	job.owner = owner
+	job.token = request.CancelToken
+	job.release = release
+	return job, nil
+}
+
+// invalid or over the limits
+func rejectAttach(err error, c *gin.Context) {
+	if err, ok := err.(*limitError); ok {
+		metricBundles.add(1, "limited")
+		replyLimitError(err, c)
+		return
+	}
+	metricBundles.add(1, "invalid")
+	replyError(err.Error(), c)
+}
+
+// do PoW for all transactions of the job
+// do everything with trytes and save time by not convertig to trits and back
+// all constants have to be divided by 3
+func (job *attachJob) run() {
+	job.start()
+
+	trunkTransaction := job.trunk
+	branchTransaction := job.branch
+	minWeightMagnitude := job.mwm
+	mwmLabel := strconv.Itoa(minWeightMagnitude)
+
 	var prevTransaction []rune
 
-	for idx, runes := range inputRunes {
-		if interruptAttachToTangle {
-			replyError("attatchToTangle interrupted", c)
+	for idx, runes := range job.input {
+		if job.ctx.Err() != nil {
+			job.finish(JobCancelled, "attatchToTangle interrupted")
 			return
 		}
 		timestamp := getTimestamp()
@@ -211,28 +278,33 @@ func attachToTangle(request Request, c *gin.Context, t time.Time) {
 		copy(runes[consts.AttachmentTimestampLowerBoundTrinaryOffset/3:], runesTimeStampLowerBoundary[:consts.AttachmentTimestampLowerBoundTrinarySize/3])
 		copy(runes[consts.AttachmentTimestampUpperBoundTrinaryOffset/3:], runesTimeStampUpperBoundary[:consts.AttachmentTimestampUpperBoundTrinarySize/3])
 
-		var powFunc pow.ProofOfWorkFunc
-
 		// do pow
-		logs.Log.Info("[PoW] Using PiDiver")
-		powFunc = powFuncs[0]
-
+		job.startTransaction(idx)
 		startTime := time.Now()
-		nonceTrytes, err := powFunc(trinary.Trytes(runes), minWeightMagnitude)
-		if err != nil || len(nonceTrytes) != consts.NonceTrinarySize/3 {
-			replyError("PoW failed!", c)
+		report, err := pool.PoWWithReport(job.ctx, trinary.Trytes(runes), minWeightMagnitude)
+		if errors.Is(err, pidiver.ErrCancelled) {
+			metricTransactions.add(1, "cancelled")
+			job.finish(JobCancelled, "attatchToTangle interrupted")
+			return
+		}
+		if err != nil || len(report.Nonce) != consts.NonceTrinarySize/3 {
+			metricTransactions.add(1, "failed")
+			job.finish(JobFailed, "PoW failed!")
 			return
 		}
 		elapsedTime := time.Now().Sub(startTime)
-		logs.Log.Info("[PoW] Needed", elapsedTime)
+		metricPowDuration.observe(elapsedTime.Seconds(), mwmLabel)
+		logs.Log.Infof("[PoW] Needed %v on %s %s (wait %v, midstate %v, search %v, %.2fMH/s, retries %d)",
+			elapsedTime, report.Type, report.Device, report.Wait, report.Midstate, report.Search, report.HashRate()/1000000.0, report.Retries)
 
 		// copy nonce to runes
-		copy(runes[consts.NonceTrinaryOffset/3:], toRunes(nonceTrytes)[:consts.NonceTrinarySize/3])
+		copy(runes[consts.NonceTrinaryOffset/3:], toRunes(report.Nonce)[:consts.NonceTrinarySize/3])
 
 		logs.Log.Debug(string(runes))
 		verifyTrytes, err := trinary.NewTrytes(string(runes))
 		if err != nil {
-			replyError("Trytes got corrupted", c)
+			metricTransactions.add(1, "failed")
+			job.finish(JobFailed, "Trytes got corrupted")
 			return
 		}
 
@@ -240,18 +312,18 @@ func attachToTangle(request Request, c *gin.Context, t time.Time) {
 		hash := curl.HashTrytes(verifyTrytes)
 		hashTrits, _ := trinary.TrytesToTrits(hash)
 		if !IsValidPoW(hashTrits, minWeightMagnitude) {
-			replyError("Nonce verify failed", c)
+			metricTransactions.add(1, "failed")
+			job.finish(JobFailed, "Nonce verify failed")
 			return
 		}
 
 		logs.Log.Info("[PoW] Verified!")
+		metricTransactions.add(1, "ok")
 
-		returnTrytes[idx] = string(runes)
+		job.finishTransaction(idx, string(runes), string(hash), elapsedTime, report)
 
 		prevTransaction = toRunes(hash)
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"trytes": returnTrytes,
-	})
+	job.finish(JobDone, "")
 }
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shufps/pidiver/server/logs"
+)
+
+var startTime = time.Now() // reset by Start
+
+func init() {
+	addAPICall("getPiDiverInfo", getPiDiverInfo, mainAPICalls)
+	addAPICall("getNodeAPIConfiguration", getNodeAPIConfiguration, mainAPICalls)
+}
+
+func SetServerVersion(version string) {
+	serverVersion = version
+}
+
+type deviceInfo struct {
+	Index      int    `json:"index"`
+	Type       string `json:"type"`
+	Device     string `json:"device,omitempty"`
+	Version    string `json:"version"`
+	Parallel   uint32 `json:"parallel"`
+	Core       string `json:"core,omitempty"`
+	CoreSHA256 string `json:"coreSHA256,omitempty"`
+	UseCRC     bool   `json:"useCRC"`
+	SharedLock bool   `json:"sharedLock"`
+	State      string `json:"state"`
+	Requests   uint64 `json:"requests"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+// hardware serving the PoW and the limits of attachToTangle
+func getPiDiverInfo(request Request, c *gin.Context, t time.Time) {
+	var devices []deviceInfo
+	var parallel uint32
+	if pool != nil {
+		for _, status := range pool.Devices() {
+			info := deviceInfo{
+				Index:      status.Index,
+				Type:       status.Info.Type,
+				Device:     status.Info.Device,
+				Version:    status.Info.Version,
+				Parallel:   status.Info.Parallel,
+				Core:       status.Info.Core,
+				CoreSHA256: status.Info.CoreSHA256,
+				UseCRC:     status.Info.UseCRC,
+				SharedLock: status.Info.Shared,
+				State:      status.State.String(),
+				Requests:   status.Requests,
+			}
+			if status.LastError != nil {
+				info.LastError = status.LastError.Error()
+			}
+			devices = append(devices, info)
+		}
+		parallel = pool.Info().Parallel
+	}
+
+	maxMWM, maxTx := requestLimits(c)
+	c.JSON(http.StatusOK, gin.H{
+		"appVersion":            serverVersion,
+		"devices":               devices,
+		"parallel":              parallel,
+		"maxMinWeightMagnitude": maxMWM,
+		"maxTransactions":       maxTx,
+		"uptime":                int64(time.Since(startTime) / time.Millisecond),
+		"duration":              getDuration(t),
+	})
+}
+
+// IRI command - the configuration of the node with the PoW limits of this server.
+// Without a node or the proxy role of the key only the limits are returned.
+func getNodeAPIConfiguration(request Request, c *gin.Context, t time.Time) {
+	configuration := nodeAPIConfiguration(c)
+	if c.Request.Context().Err() != nil {
+		return
+	}
+	configuration["maxMinWeightMagnitude"], configuration["maxTransactions"] = requestLimits(c)
+	configuration["duration"] = getDuration(t)
+	c.JSON(http.StatusOK, configuration)
+}
+
+func nodeAPIConfiguration(c *gin.Context) gin.H {
+	configuration := gin.H{}
+	if proxy == nil || !requestHasRole(c, RoleProxy) || !proxy.allowed("getnodeapiconfiguration") {
+		return configuration
+	}
+	body, _ := c.Get(gin.BodyBytesKey)
+	resp, node, err := proxy.roundTrip(c, body.([]byte))
+	if err != nil {
+		logs.Log.Warning("getNodeAPIConfiguration without node:", err)
+		return configuration
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logs.Log.Warningf("getNodeAPIConfiguration of %s failed: %s", node.url, resp.Status)
+		return configuration
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&configuration); err != nil {
+		logs.Log.Warningf("getNodeAPIConfiguration of %s: %v", node.url, err)
+		return gin.H{}
+	}
+	return configuration
+}
@@ -0,0 +1,412 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shufps/pidiver/pidiver"
+	"github.com/shufps/pidiver/server/config"
+	"github.com/shufps/pidiver/server/logs"
+)
+
+// attach jobs - attachToTangleAsync returns a job id which is used to poll the
+// status, fetch the result and cancel the job. attachToTangle runs a job and waits for it.
+
+type JobState int
+
+const (
+	JobQueued JobState = iota
+	JobRunning
+	JobDone
+	JobFailed
+	JobCancelled
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	case JobCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// label of pidiver_bundles_total
+func (s JobState) metric() string {
+	if s == JobDone {
+		return "ok"
+	}
+	return s.String()
+}
+
+type TransactionState int
+
+const (
+	TransactionPending TransactionState = iota
+	TransactionRunning
+	TransactionDone
+)
+
+func (s TransactionState) String() string {
+	switch s {
+	case TransactionPending:
+		return "pending"
+	case TransactionRunning:
+		return "running"
+	case TransactionDone:
+		return "done"
+	}
+	return "unknown"
+}
+
+type transactionStatus struct {
+	Index    int    `json:"index"`
+	Status   string `json:"status"`
+	Hash     string `json:"hash,omitempty"`
+	Duration int64  `json:"duration,omitempty"` // ms
+	Device   string `json:"device,omitempty"`
+}
+
+type jobStatus struct {
+	JobId        string              `json:"jobId"`
+	Status       string              `json:"status"`
+	Error        string              `json:"error,omitempty"`
+	Done         int                 `json:"done"`
+	Total        int                 `json:"total"`
+	Created      int64               `json:"created"`            // unix ms
+	Duration     int64               `json:"duration,omitempty"` // ms since start (or until finished)
+	Transactions []transactionStatus `json:"transactions"`
+}
+
+type attachJob struct {
+	id     string
+	trunk  []rune
+	branch []rune
+	mwm    int
+	input  [][]rune
+	owner  string // address of the client
+	token  string // cancelToken of the request
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	events  chan transactionStatus // finished transactions (nil: not streamed) - closed when the job is finished
+	release func(completed int)    // rate limits of the bundle
+
+	lock         sync.Mutex
+	state        JobState
+	err          string
+	trytes       []string
+	transactions []transactionStatus
+	created      time.Time
+	started      time.Time
+	finished     time.Time
+}
+
+func newJob(parent context.Context, trunk []rune, branch []rune, mwm int, input [][]rune) *attachJob {
+	ctx, cancel := context.WithCancel(parent)
+	job := &attachJob{
+		id:           newJobID(),
+		trunk:        trunk,
+		branch:       branch,
+		mwm:          mwm,
+		input:        input,
+		ctx:          ctx,
+		cancel:       cancel,
+		trytes:       make([]string, len(input)),
+		transactions: make([]transactionStatus, len(input)),
+		release:      func(int) {},
+		created:      time.Now(),
+	}
+	for idx := range job.transactions {
+		job.transactions[idx] = transactionStatus{Index: idx, Status: TransactionPending.String()}
+	}
+	return job
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (job *attachJob) start() {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.state = JobRunning
+	job.started = time.Now()
+}
+
+func (job *attachJob) startTransaction(idx int) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.transactions[idx].Status = TransactionRunning.String()
+}
+
+// stream the finished transactions - must be called before run
+func (job *attachJob) stream() <-chan transactionStatus {
+	job.events = make(chan transactionStatus, len(job.input))
+	return job.events
+}
+
+func (job *attachJob) finishTransaction(idx int, trytes string, hash string, duration time.Duration, report *pidiver.PoWReport) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.trytes[idx] = trytes
+	job.transactions[idx].Status = TransactionDone.String()
+	job.transactions[idx].Hash = hash
+	job.transactions[idx].Duration = int64(duration / time.Millisecond)
+	job.transactions[idx].Device = report.Device
+	if job.transactions[idx].Device == "" {
+		job.transactions[idx].Device = report.Type
+	}
+	if job.events != nil {
+		job.events <- job.transactions[idx]
+	}
+}
+
+func (job *attachJob) finish(state JobState, err string) {
+	job.lock.Lock()
+	job.state = state
+	job.err = err
+	job.finished = time.Now()
+	job.input = nil
+	completed := 0
+	for idx := range job.transactions {
+		switch job.transactions[idx].Status {
+		case TransactionRunning.String():
+			job.transactions[idx].Status = TransactionPending.String()
+		case TransactionDone.String():
+			completed++
+		}
+	}
+	if job.events != nil {
+		close(job.events)
+	}
+	job.lock.Unlock()
+	job.cancel()
+	job.release(completed)
+	metricBundles.add(1, state.metric())
+}
+
+func (job *attachJob) isFinished() bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.state >= JobDone
+}
+
+func (job *attachJob) status() jobStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	status := jobStatus{
+		JobId:        job.id,
+		Status:       job.state.String(),
+		Error:        job.err,
+		Total:        len(job.transactions),
+		Created:      job.created.UnixNano() / int64(time.Millisecond),
+		Transactions: append([]transactionStatus{}, job.transactions...),
+	}
+	for _, tx := range job.transactions {
+		if tx.Status == TransactionDone.String() {
+			status.Done++
+		}
+	}
+	if !job.started.IsZero() {
+		end := job.finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		status.Duration = int64(end.Sub(job.started) / time.Millisecond)
+	}
+	return status
+}
+
+// trytes with nonces - only complete if the job is done
+func (job *attachJob) result() []string {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return append([]string{}, job.trytes...)
+}
+
+type jobRegistry struct {
+	lock sync.Mutex
+	jobs map[string]*attachJob
+	max  int           // max. number of unfinished async jobs (0: unlimited)
+	keep time.Duration // finished jobs are removed after this time
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*attachJob)}
+
+var errTooManyJobs = errors.New("Too many attach jobs")
+
+func init() {
+	addAPICall("attachToTangleAsync", attachToTangleAsync, mainAPICalls)
+	addAPICall("getAttachJobStatus", getAttachJobStatus, mainAPICalls)
+	addAPICall("getAttachJobResult", getAttachJobResult, mainAPICalls)
+	addAPICall("cancelAttachJob", cancelAttachJob, mainAPICalls)
+}
+
+func startJobs() {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	jobs.max = config.AppConfig.GetInt("api.jobs.maxJobs")
+	jobs.keep = config.AppConfig.GetDuration("api.jobs.keepFinished")
+
+	logs.Log.Debug("maxJobs:", jobs.max)
+	logs.Log.Debug("keepFinished:", jobs.keep)
+}
+
+func (r *jobRegistry) add(job *attachJob) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.jobs[job.id] = job
+}
+
+// add an async job if the limit isn't reached
+func (r *jobRegistry) addAsync(job *attachJob) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+	if r.max > 0 {
+		running := 0
+		for _, j := range r.jobs {
+			if !j.isFinished() {
+				running++
+			}
+		}
+		if running >= r.max {
+			return errTooManyJobs
+		}
+	}
+	r.jobs[job.id] = job
+	return nil
+}
+
+func (r *jobRegistry) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.jobs, id)
+}
+
+func (r *jobRegistry) get(id string) (*attachJob, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+func (r *jobRegistry) cancelAll() {
+	r.cancelWhere(func(job *attachJob) bool { return true })
+}
+
+// cancel the unfinished jobs matching f
+func (r *jobRegistry) cancelWhere(f func(job *attachJob) bool) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for _, job := range r.jobs {
+		if !job.isFinished() && f(job) {
+			job.cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// must be called with lock held
+func (r *jobRegistry) expire() {
+	for id, job := range r.jobs {
+		job.lock.Lock()
+		expired := !job.finished.IsZero() && time.Since(job.finished) > r.keep
+		job.lock.Unlock()
+		if expired {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// the job isn't bound to the request - it's cancelled with cancelAttachJob or interruptAttachingToTangle
+func attachToTangleAsync(request Request, c *gin.Context, t time.Time) {
+	job, err := newAttachJob(context.Background(), request, c)
+	if err != nil {
+		rejectAttach(err, c)
+		return
+	}
+	if err := jobs.addAsync(job); err != nil {
+		job.release(0)
+		replyError(err.Error(), c)
+		return
+	}
+	go job.run()
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobId":    job.id,
+		"duration": getDuration(t),
+	})
+}
+
+// jobs of other owners are unknown to the caller - admins see all jobs
+func requestedJob(request Request, c *gin.Context) (*attachJob, bool) {
+	job, ok := jobs.get(request.JobId)
+	if ok && job.owner != requestOwner(c) && !(apiKeys != nil && requestHasRole(c, RoleAdmin)) {
+		logs.Log.Infof("Denying job %s of %s to %s", job.id, job.owner, requestOwner(c))
+		ok = false
+	}
+	if !ok {
+		replyError("Unknown jobId", c)
+	}
+	return job, ok
+}
+
+func getAttachJobStatus(request Request, c *gin.Context, t time.Time) {
+	job, ok := requestedJob(request, c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job.status())
+}
+
+func getAttachJobResult(request Request, c *gin.Context, t time.Time) {
+	job, ok := requestedJob(request, c)
+	if !ok {
+		return
+	}
+	status := job.status()
+	switch status.Status {
+	case JobDone.String():
+		c.JSON(http.StatusOK, gin.H{
+			"trytes":   job.result(),
+			"duration": getDuration(t),
+		})
+	case JobFailed.String(), JobCancelled.String():
+		replyError(status.Error, c)
+	default:
+		replyError("Job not finished", c)
+	}
+}
+
+func cancelAttachJob(request Request, c *gin.Context, t time.Time) {
+	job, ok := requestedJob(request, c)
+	if !ok {
+		return
+	}
+	job.cancel()
+	c.JSON(http.StatusOK, gin.H{
+		"duration": getDuration(t),
+	})
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func jobRequest(remote string, key *APIKey, jobId string) (*attachJob, bool, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	c.Request.RemoteAddr = remote
+	if key != nil {
+		c.Set(apiKeyContextKey, key)
+	}
+	job, ok := requestedJob(Request{Command: "getAttachJobStatus", JobId: jobId}, c)
+	return job, ok, w
+}
+
+func TestRequestedJobOfOtherOwner(t *testing.T) {
+	job := newJob(context.Background(), nil, nil, 9, nil)
+	job.owner = "10.0.0.1"
+	jobs.add(job)
+	defer jobs.remove(job.id)
+
+	if _, ok, _ := jobRequest("10.0.0.1:4711", nil, job.id); !ok {
+		t.Error("owner can't access the job")
+	}
+	if _, ok, w := jobRequest("10.0.0.2:4711", nil, job.id); ok || w.Body.String() != `{"error":"Unknown jobId"}` {
+		t.Errorf("other client got the job: %s", w.Body.String())
+	}
+
+	// with keys only admins see the jobs of others
+	apiKeys = &keyStore{}
+	defer func() { apiKeys = nil }()
+	if _, ok, _ := jobRequest("10.0.0.2:4711", &APIKey{Name: "pow", role: RoleProxy}, job.id); ok {
+		t.Error("job of another owner found")
+	}
+	if _, ok, _ := jobRequest("10.0.0.2:4711", &APIKey{Name: "admin", role: RoleAdmin}, job.id); !ok {
+		t.Error("admin can't access the job")
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shufps/pidiver/server/config"
+	"github.com/shufps/pidiver/server/logs"
+	"github.com/spf13/viper"
+)
+
+// api keys from api.keys.file (json, toml or yaml). The key is sent in the
+// api.keys.header header. The file is reloaded when it changes.
+//
+// roles:
+//   pow   - local PoW commands (attachToTangle, jobs, interrupt, info)
+//   proxy - pow and the commands which are proxied to the node
+//   admin - proxy, commands of api.limitRemoteAccess and the metrics
+
+type KeyRole int
+
+const (
+	RolePoW KeyRole = iota
+	RoleProxy
+	RoleAdmin
+)
+
+func (r KeyRole) String() string {
+	switch r {
+	case RolePoW:
+		return "pow"
+	case RoleProxy:
+		return "proxy"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+func parseRole(role string) (KeyRole, error) {
+	switch strings.ToLower(role) {
+	case "pow", "pow-only":
+		return RolePoW, nil
+	case "proxy":
+		return RoleProxy, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RolePoW, fmt.Errorf("unknown role %q", role)
+}
+
+// entry of the keys file
+type APIKey struct {
+	Name                  string
+	Key                   string
+	Role                  string
+	MaxMinWeightMagnitude int   // 0: api.pow.maxMinWeightMagnitude
+	MaxTransactions       int   // 0: api.pow.maxTransactions
+	Enabled               *bool // missing: enabled
+
+	// rate limits (0: api.limits.*)
+	TransactionsPerMinute int
+	BundlesInFlight       int
+	DailyWork             float64
+
+	role KeyRole
+}
+
+func (k *APIKey) enabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+type keyStore struct {
+	lock     sync.RWMutex
+	filename string
+	header   string
+	modified time.Time
+	keys     map[string]*APIKey // by key
+}
+
+var apiKeys *keyStore // nil: no keys file
+
+const apiKeyContextKey = "apiKey"
+
+var (
+	errNoKey       = errors.New("API key missing")
+	errUnknownKey  = errors.New("Invalid API key")
+	errDisabledKey = errors.New("API key disabled")
+)
+
+func configureAPIKeys() {
+	filename := config.AppConfig.GetString("api.keys.file")
+	if filename == "" {
+		return
+	}
+	store := &keyStore{
+		filename: filename,
+		header:   config.AppConfig.GetString("api.keys.header"),
+	}
+	if err := store.load(); err != nil {
+		logs.Log.Fatalf("API keys could not be loaded from %s: %v", filename, err)
+	}
+	apiKeys = store
+
+	interval := config.AppConfig.GetDuration("api.keys.reloadInterval")
+	if interval > 0 {
+		go store.watch(interval)
+	}
+	api.Use(apiKeyAuthentication)
+}
+
+func (s *keyStore) load() error {
+	stat, err := os.Stat(s.filename)
+	if err != nil {
+		return err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(s.filename)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	var list []*APIKey
+	if err := v.UnmarshalKey("keys", &list); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*APIKey)
+	for _, key := range list {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("key %q: name and key needed", key.Name)
+		}
+		if _, dup := keys[key.Key]; dup {
+			return fmt.Errorf("key %q used twice", key.Name)
+		}
+		if key.role, err = parseRole(key.Role); err != nil {
+			return fmt.Errorf("key %q: %v", key.Name, err)
+		}
+		keys[key.Key] = key
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = keys
+	s.modified = stat.ModTime()
+	logs.Log.Infof("Loaded %d API keys from %s", len(keys), s.filename)
+	return nil
+}
+
+// reload the file if it was modified - the old keys stay if it's broken
+func (s *keyStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		stat, err := os.Stat(s.filename)
+		if err != nil {
+			logs.Log.Warningf("API keys file %s: %v", s.filename, err)
+			continue
+		}
+		s.lock.RLock()
+		modified := !stat.ModTime().Equal(s.modified)
+		s.lock.RUnlock()
+		if !modified {
+			continue
+		}
+		if err := s.load(); err != nil {
+			logs.Log.Errorf("API keys could not be reloaded from %s: %v", s.filename, err)
+		}
+	}
+}
+
+func (s *keyStore) lookup(key string) (*APIKey, error) {
+	if key == "" {
+		return nil, errNoKey
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	apiKey, ok := s.keys[key]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	if !apiKey.enabled() {
+		return nil, errDisabledKey
+	}
+	return apiKey, nil
+}
+
+func apiKeyAuthentication(c *gin.Context) {
+	key, err := apiKeys.lookup(c.GetHeader(apiKeys.header))
+	if err != nil {
+		logs.Log.Infof("Denying request from remote %v: %v", c.Request.RemoteAddr, err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.Set(apiKeyContextKey, key)
+	c.Next()
+}
+
+// key of the request (nil if there are no keys)
+func requestKey(c *gin.Context) *APIKey {
+	if key, ok := c.Get(apiKeyContextKey); ok {
+		return key.(*APIKey)
+	}
+	return nil
+}
+
+// name of the key for the logs
+func requestKeyName(c *gin.Context) string {
+	if key := requestKey(c); key != nil {
+		return key.Name
+	}
+	return "-"
+}
+
+// without keys everything is allowed
+func requestHasRole(c *gin.Context, role KeyRole) bool {
+	if apiKeys == nil {
+		return true
+	}
+	key := requestKey(c)
+	return key != nil && key.role >= role
+}
+
+// limits of attachToTangle for the key of the request
+func requestLimits(c *gin.Context) (maxMWM int, maxTx int) {
+	maxMWM, maxTx = maxMinWeightMagnitude, maxTransactions
+	if key := requestKey(c); key != nil {
+		if key.MaxMinWeightMagnitude > 0 {
+			maxMWM = key.MaxMinWeightMagnitude
+		}
+		if key.MaxTransactions > 0 {
+			maxTx = key.MaxTransactions
+		}
+	}
+	return maxMWM, maxTx
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shufps/pidiver/pidiver"
+	"github.com/shufps/pidiver/server/config"
+	"github.com/shufps/pidiver/server/logs"
+)
+
+// Prometheus metrics in the text exposition format. The metric names are stable
+// and listed in the block comment above declareAPIConfigs in server/config/config.go.
+
+var (
+	powBuckets  = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	waitBuckets = []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+	metricPowDuration = newHistogramVec("pidiver_pow_duration_seconds",
+		"PoW duration of a transaction (including queue wait) by min weight magnitude", []string{"mwm"}, powBuckets)
+	metricQueueWait = newHistogramVec("pidiver_pow_queue_wait_seconds",
+		"Time a transaction waited for an idle device", nil, waitBuckets)
+	metricHashRate = newGaugeVec("pidiver_hashrate_hashes_per_second",
+		"Hash rate of the last PoW of a device (nonce * parallel level / time)", []string{"device"})
+	metricHashes = newCounterVec("pidiver_hashes_total",
+		"Hashes calculated by a device", []string{"device"})
+	metricDeviceErrors = newCounterVec("pidiver_device_errors_total",
+		"Failed device operations by error type", []string{"device", "type"})
+	metricTransactions = newCounterVec("pidiver_transactions_total",
+		"Transactions of attachToTangle by status (ok, failed, cancelled)", []string{"status"})
+	metricBundles = newCounterVec("pidiver_bundles_total",
+		"attachToTangle requests by status (ok, failed, cancelled, invalid, limited)", []string{"status"})
+
+	metrics = []metric{metricPowDuration, metricQueueWait, metricHashRate, metricHashes, metricDeviceErrors, metricTransactions, metricBundles}
+)
+
+func configureMetrics() {
+	if !config.AppConfig.GetBool("api.metrics.enabled") {
+		return
+	}
+	path := config.AppConfig.GetString("api.metrics.path")
+	api.GET(path, func(c *gin.Context) {
+		if !requestHasRole(c, RoleAdmin) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		writeMetrics(c.Writer)
+	})
+	logs.Log.Debug("metrics on", path)
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range metrics {
+		m.write(w)
+	}
+	writePoolMetrics(w)
+}
+
+// device metrics are read from the pool on every scrape
+func writePoolMetrics(w io.Writer) {
+	if pool == nil {
+		return
+	}
+	up := newGaugeVec("pidiver_device_up", "1 if the device is in rotation, 0 if it failed", []string{"index", "type", "device"})
+	requests := newCounterVec("pidiver_device_pow_total", "Successful PoWs of a device", []string{"index", "type", "device"})
+	crcErrors := newCounterVec("pidiver_device_crc_errors_total", "CRC errors of midstate blocks (recovered or not)", []string{"index", "type", "device"})
+	transportErrors := newCounterVec("pidiver_device_transport_errors_total", "Failed transfers to a device (recovered or not)", []string{"index", "type", "device"})
+	for _, status := range pool.Devices() {
+		labels := []string{strconv.Itoa(status.Index), status.Info.Type, status.Info.Device}
+		value := 1.0
+		if status.State == pidiver.DeviceFailed {
+			value = 0
+		}
+		up.set(value, labels...)
+		requests.add(float64(status.Requests), labels...)
+		if status.Stats != nil {
+			crcErrors.add(float64(status.Stats.CRCErrors), labels...)
+			transportErrors.add(float64(status.Stats.TransportErrors), labels...)
+		}
+	}
+	for _, m := range []metric{up, requests, crcErrors, transportErrors} {
+		m.write(w)
+	}
+}
+
+// progress events of the devices (PiDiverConfig.OnEvent)
+func DeviceEventHandler(event pidiver.Event) {
+	if !event.Done {
+		return
+	}
+	if event.Err != nil {
+		if !errors.Is(event.Err, pidiver.ErrCancelled) {
+			metricDeviceErrors.add(1, event.Device, errorType(event.Err))
+		}
+		return
+	}
+	if event.Phase == pidiver.PhasePoW && event.Hashes > 0 {
+		metricHashes.add(float64(event.Hashes), event.Device)
+		if seconds := event.Elapsed.Seconds(); seconds > 0 {
+			metricHashRate.set(float64(event.Hashes)/seconds, event.Device)
+		}
+	}
+}
+
+func errorType(err error) string {
+	for _, e := range []struct {
+		err  error
+		name string
+	}{
+		{pidiver.ErrTransmission, "transmission"},
+		{pidiver.ErrCRC, "crc"},
+		{pidiver.ErrProtocol, "protocol"},
+		{pidiver.ErrTimeout, "timeout"},
+		{pidiver.ErrDeviceGone, "device_gone"},
+		{pidiver.ErrReservation, "reservation"},
+		{pidiver.ErrNotConfigured, "not_configured"},
+	} {
+		if errors.Is(err, e.err) {
+			return e.name
+		}
+	}
+	return "other"
+}
+
+func observeQueueWait(wait time.Duration) {
+	metricQueueWait.observe(wait.Seconds())
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// values by label values
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string][]string // key -> label values
+}
+
+func newVec(name string, help string, kind string, labels []string) vec {
+	return vec{name: name, help: help, kind: kind, labels: labels, values: make(map[string][]string)}
+}
+
+// must be called with lock held
+func (v *vec) key(values []string) string {
+	key := strings.Join(values, "\xff")
+	if _, ok := v.values[key]; !ok {
+		v.values[key] = append([]string{}, values...)
+	}
+	return key
+}
+
+// must be called with lock held
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+// label values may only escape backslash, double quote and line feed
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// {a="1",b="2"} with extra label (e.g. le) if name isn't empty
+func (v *vec) labelString(values []string, name string, value string) string {
+	var pairs []string
+	for i, label := range v.labels {
+		pairs = append(pairs, label+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if name != "" {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	vec
+	counts map[string]float64
+}
+
+func newCounterVec(name string, help string, labels []string) *counterVec {
+	return &counterVec{vec: newVec(name, help, "counter", labels), counts: make(map[string]float64)}
+}
+
+func (c *counterVec) add(value float64, labels ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[c.key(labels)] += value
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.header(w)
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(c.values[key], "", ""), formatFloat(c.counts[key]))
+	}
+}
+
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name string, help string, labels []string) *gaugeVec {
+	g := &gaugeVec{counterVec: *newCounterVec(name, help, labels)}
+	g.kind = "gauge"
+	return g
+}
+
+func (g *gaugeVec) set(value float64, labels ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.counts[g.key(labels)] = value
+}
+
+type histogram struct {
+	buckets []uint64 // not cumulative
+	sum     float64
+	count   uint64
+}
+
+type histogramVec struct {
+	vec
+	bounds     []float64
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, labels []string, bounds []float64) *histogramVec {
+	return &histogramVec{vec: newVec(name, help, "histogram", labels), bounds: bounds, histograms: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(value float64, labels ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := h.key(labels)
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(h.bounds))}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.bounds {
+		if value <= bound {
+			hist.buckets[i]++
+			break
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.header(w)
+	for _, key := range h.sortedKeys() {
+		values := h.values[key]
+		hist := h.histograms[key]
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += hist.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(values, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(values, "", ""), hist.count)
+	}
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	metricTransactions.add(2, "metrics_test")
+	metricTransactions.add(1, "metrics_test")
+	metricHashRate.set(5, "dev\\ice \"0\"\n")
+	metricHashRate.set(1500, "dev\\ice \"0\"\n")
+	metricPowDuration.observe(0.3, "metrics_test")
+	metricPowDuration.observe(7, "metrics_test")
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE pidiver_transactions_total counter",
+		`pidiver_transactions_total{status="metrics_test"} 3`,
+		"# TYPE pidiver_hashrate_hashes_per_second gauge",
+		`pidiver_hashrate_hashes_per_second{device="dev\\ice \"0\"\n"} 1500`,
+		"# TYPE pidiver_pow_duration_seconds histogram",
+		`pidiver_pow_duration_seconds_bucket{mwm="metrics_test",le="0.25"} 0`,
+		`pidiver_pow_duration_seconds_bucket{mwm="metrics_test",le="0.5"} 1`,
+		`pidiver_pow_duration_seconds_bucket{mwm="metrics_test",le="10"} 2`,
+		`pidiver_pow_duration_seconds_bucket{mwm="metrics_test",le="+Inf"} 2`,
+		`pidiver_pow_duration_seconds_sum{mwm="metrics_test"} 7.3`,
+		`pidiver_pow_duration_seconds_count{mwm="metrics_test"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	v := newVec("test", "", "gauge", []string{"a"})
+	// only backslash, double quote and line feed are escaped - no go escapes like \t or \u
+	if s := v.labelString([]string{"x\\y\"z\n\tä"}, "le", "1"); s != `{a="x\\y\"z\n`+"\tä"+`",le="1"}` {
+		t.Errorf("labels %s", s)
+	}
+}
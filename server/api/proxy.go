@@ -0,0 +1,286 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shufps/pidiver/server/config"
+	"github.com/shufps/pidiver/server/logs"
+)
+
+// reverse proxy for all commands which aren't handled by the server. The request
+// goes to the first healthy node of api.proxy.nodes - if a node can't be reached,
+// the next one is tried.
+
+const (
+	IRI_DEFAULT_PORT = 14265
+)
+
+// not forwarded to the node or back to the client
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Authorization", // credentials of this server
+	"Content-Length",
+}
+
+var errNodeDown = errors.New("node not available")
+
+type proxyNode struct {
+	url string
+
+	lock      sync.Mutex
+	healthy   bool
+	lastError error
+}
+
+func (n *proxyNode) setHealthy(healthy bool, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if healthy != n.healthy {
+		if healthy {
+			logs.Log.Infof("Node %s is up", n.url)
+		} else {
+			logs.Log.Warningf("Node %s is down: %v", n.url, err)
+		}
+	}
+	n.healthy = healthy
+	n.lastError = err
+}
+
+func (n *proxyNode) isHealthy() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.healthy
+}
+
+type nodeProxy struct {
+	nodes     []*proxyNode
+	client    *http.Client
+	whitelist map[string]bool // empty: all commands
+	blacklist map[string]bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+var proxy *nodeProxy
+
+func configureProxy() {
+	urls := config.AppConfig.GetStringSlice("api.proxy.nodes")
+	if len(urls) == 0 {
+		// nodes of the old config
+		urls = []string{config.AppConfig.GetString("api.http.node"), config.AppConfig.GetString("api.https.node")}
+	}
+	proxy = newNodeProxy(urls, config.AppConfig.GetDuration("api.proxy.timeout"),
+		config.AppConfig.GetStringSlice("api.proxy.whitelist"), config.AppConfig.GetStringSlice("api.proxy.blacklist"))
+	logs.Log.Debug("Proxy nodes:", urls)
+
+	interval := config.AppConfig.GetDuration("api.proxy.healthCheckInterval")
+	if interval > 0 && len(proxy.nodes) > 0 {
+		go proxy.healthChecks(interval)
+	}
+}
+
+func newNodeProxy(urls []string, timeout time.Duration, whitelist []string, blacklist []string) *nodeProxy {
+	p := &nodeProxy{
+		client:    &http.Client{Timeout: timeout},
+		whitelist: commandSet(whitelist),
+		blacklist: commandSet(blacklist),
+		stop:      make(chan struct{}),
+	}
+	known := make(map[string]bool)
+	for _, url := range urls {
+		url = nodeURL(url)
+		if url == "" || known[url] {
+			continue
+		}
+		known[url] = true
+		// healthy until the first check says otherwise
+		p.nodes = append(p.nodes, &proxyNode{url: url, healthy: true})
+	}
+	return p
+}
+
+// stops the health checks - requests which are still running can use the proxy
+func stopProxy() {
+	if p := proxy; p != nil {
+		p.stopOnce.Do(func() { close(p.stop) })
+	}
+}
+
+func commandSet(commands []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, command := range commands {
+		set[strings.ToLower(command)] = true
+	}
+	return set
+}
+
+// host or url of a node - plain hosts get http and the iri port
+func nodeURL(node string) string {
+	node = strings.TrimRight(strings.TrimSpace(node), "/")
+	if node == "" || strings.Contains(node, "://") {
+		return node
+	}
+	if !strings.Contains(node, ":") {
+		node = fmt.Sprintf("%s:%d", node, IRI_DEFAULT_PORT)
+	}
+	return "http://" + node
+}
+
+func (p *nodeProxy) allowed(caseInsensitiveCommand string) bool {
+	if p.blacklist[caseInsensitiveCommand] {
+		return false
+	}
+	return len(p.whitelist) == 0 || p.whitelist[caseInsensitiveCommand]
+}
+
+// healthy nodes first, the others in case the checks are out of date
+func (p *nodeProxy) candidates() []*proxyNode {
+	var healthy, unhealthy []*proxyNode
+	for _, node := range p.nodes {
+		if node.isHealthy() {
+			healthy = append(healthy, node)
+		} else {
+			unhealthy = append(unhealthy, node)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// forward the original body and headers of c to the nodes until one answers
+func (p *nodeProxy) forward(c *gin.Context, body []byte) {
+	resp, node, err := p.roundTrip(c, body)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			logs.Log.Error("Proxy failed:", err)
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": "No IOTA node available",
+			})
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	header := c.Writer.Header()
+	for key, values := range resp.Header {
+		// cors headers are set by this server
+		if strings.HasPrefix(key, "Access-Control-") {
+			continue
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		logs.Log.Warningf("Proxy response from %s incomplete: %v", node.url, err)
+	}
+}
+
+// send the request to the nodes until one answers - the caller closes the body
+func (p *nodeProxy) roundTrip(c *gin.Context, body []byte) (*http.Response, *proxyNode, error) {
+	var lastErr error = errNodeDown
+	for _, node := range p.candidates() {
+		resp, err := p.send(node, c, body)
+		if err != nil && c.Request.Context().Err() != nil {
+			// the client is gone - it's not the fault of the node
+			logs.Log.Debugf("Proxy request to %s cancelled: %v", node.url, err)
+			return nil, node, err
+		}
+		if err != nil {
+			node.setHealthy(false, err)
+			lastErr = err
+			continue
+		}
+		node.setHealthy(true, nil)
+		return resp, node, nil
+	}
+	return nil, nil, lastErr
+}
+
+// errors and gateway errors of the node count as failures - other status codes are passed on
+func (p *nodeProxy) send(node *proxyNode, c *gin.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, node.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(c.Request.Context())
+	for key, values := range c.Request.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	for _, key := range hopHeaders {
+		req.Header.Del(key)
+	}
+	if apiKeys != nil {
+		req.Header.Del(apiKeys.header)
+	}
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded+", "+c.ClientIP())
+	} else {
+		req.Header.Set("X-Forwarded-For", c.ClientIP())
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errNodeDown, resp.Status)
+	}
+	return resp, nil
+}
+
+func (p *nodeProxy) healthChecks(interval time.Duration) {
+	for {
+		for _, node := range p.nodes {
+			node.setHealthy(p.check(node))
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// getNodeInfo has to succeed
+func (p *nodeProxy) check(node *proxyNode) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, node.url, strings.NewReader(`{"command":"getNodeInfo"}`))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-IOTA-API-Version", "1")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%w: %s", errNodeDown, resp.Status)
+	}
+	return true, nil
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stand-in for an IOTA node - answers with status until it is changed
+type testNode struct {
+	*httptest.Server
+	status   int32
+	requests int32
+
+	lock   sync.Mutex
+	header http.Header // of the last request
+}
+
+func newTestNode(status int) *testNode {
+	n := &testNode{status: int32(status)}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n.requests, 1)
+		n.lock.Lock()
+		n.header = r.Header.Clone()
+		n.lock.Unlock()
+		w.Header().Set("Access-Control-Allow-Origin", "node")
+		w.WriteHeader(int(atomic.LoadInt32(&n.status)))
+		w.Write([]byte(`{"appName":"IRI"}`))
+	}))
+	return n
+}
+
+func (n *testNode) lastHeader() http.Header {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.header
+}
+
+func (n *testNode) setStatus(status int) {
+	atomic.StoreInt32(&n.status, int32(status))
+}
+
+func proxyRequest(ctx context.Context, p *nodeProxy) *httptest.ResponseRecorder {
+	body := []byte(`{"command":"getNodeInfo"}`)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)).WithContext(ctx)
+	c.Request.Header.Set("Authorization", "Basic secret")
+	c.Request.Header.Set("X-IOTA-API-Version", "1")
+	p.forward(c, body)
+	return w
+}
+
+func TestProxyFailover(t *testing.T) {
+	down := newTestNode(http.StatusServiceUnavailable)
+	defer down.Close()
+	up := newTestNode(http.StatusOK)
+	defer up.Close()
+	p := newNodeProxy([]string{down.URL, up.URL}, time.Second, nil, nil)
+
+	w := proxyRequest(context.Background(), p)
+	if w.Code != http.StatusOK || w.Body.String() != `{"appName":"IRI"}` {
+		t.Fatalf("response %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("cors header of the node was passed on")
+	}
+	if header := up.lastHeader(); header.Get("Authorization") != "" || header.Get("X-IOTA-API-Version") != "1" || header.Get("X-Forwarded-For") == "" {
+		t.Errorf("forwarded headers: %v", header)
+	}
+	if p.nodes[0].isHealthy() || !p.nodes[1].isHealthy() {
+		t.Error("node health not updated")
+	}
+
+	// the healthy node is tried first
+	proxyRequest(context.Background(), p)
+	if atomic.LoadInt32(&down.requests) != 1 || atomic.LoadInt32(&up.requests) != 2 {
+		t.Errorf("requests: down %d, up %d", down.requests, up.requests)
+	}
+}
+
+func TestProxyNoNode(t *testing.T) {
+	down := newTestNode(http.StatusBadGateway)
+	defer down.Close()
+	gone := newTestNode(http.StatusOK)
+	gone.Close()
+	p := newNodeProxy([]string{down.URL, gone.URL}, time.Second, nil, nil)
+
+	if w := proxyRequest(context.Background(), p); w.Code != http.StatusBadGateway {
+		t.Errorf("response %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyClientGone(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	p := newNodeProxy([]string{slow.URL, slow.URL + "/other"}, 10*time.Second, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	proxyRequest(ctx, p)
+	for _, node := range p.nodes {
+		if !node.isHealthy() {
+			t.Errorf("node %s marked down by a client disconnect", node.url)
+		}
+	}
+}
+
+func TestProxyHealthChecks(t *testing.T) {
+	node := newTestNode(http.StatusInternalServerError)
+	defer node.Close()
+	p := newNodeProxy([]string{node.URL}, time.Second, nil, nil)
+	go p.healthChecks(5 * time.Millisecond)
+	defer close(p.stop)
+
+	waitHealthy := func(healthy bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for p.nodes[0].isHealthy() != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("node not healthy=%v", healthy)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitHealthy(false)
+	node.setStatus(http.StatusOK)
+	waitHealthy(true)
+}
+
+func TestProxyCommands(t *testing.T) {
+	p := newNodeProxy(nil, time.Second, []string{"getNodeInfo", "getTips"}, []string{"getTips"})
+	if !p.allowed("getnodeinfo") || p.allowed("gettips") || p.allowed("addneighbors") {
+		t.Error("whitelist and blacklist not applied")
+	}
+	if url := nodeURL("node.example.com"); url != "http://node.example.com:14265" {
+		t.Errorf("node url: %s", url)
+	}
+}
+
+func nodeAPIConfigurationRequest(t *testing.T) map[string]interface{} {
+	body := []byte(`{"command":"getNodeAPIConfiguration"}`)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	c.Set(gin.BodyBytesKey, body)
+	getNodeAPIConfiguration(Request{Command: "getNodeAPIConfiguration"}, c, time.Now())
+
+	var configuration map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &configuration); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("response %d: %s", w.Code, w.Body.String())
+	}
+	return configuration
+}
+
+func TestNodeAPIConfigurationMergesLimits(t *testing.T) {
+	node := newTestNode(http.StatusOK)
+	defer node.Close()
+	proxy = newNodeProxy([]string{node.URL}, time.Second, nil, nil)
+	defer func() { proxy = nil }()
+
+	configuration := nodeAPIConfigurationRequest(t)
+	if configuration["appName"] != "IRI" || configuration["maxMinWeightMagnitude"] != float64(maxMinWeightMagnitude) ||
+		configuration["maxTransactions"] != float64(maxTransactions) {
+		t.Errorf("configuration: %v", configuration)
+	}
+
+	// without a node only the limits are known
+	node.setStatus(http.StatusServiceUnavailable)
+	configuration = nodeAPIConfigurationRequest(t)
+	if _, ok := configuration["appName"]; ok || configuration["maxTransactions"] != float64(maxTransactions) {
+		t.Errorf("configuration without node: %v", configuration)
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shufps/pidiver/server/config"
+	"github.com/shufps/pidiver/server/logs"
+)
+
+// limits per client (api key or address) for attachToTangle:
+// - transactions per minute (token bucket - a full bucket allows one bigger bundle)
+// - bundles in flight
+// - work per day (UTC) - every transaction counts 3^MWM expected hashes
+// The counters are saved in api.limits.store and survive restarts.
+
+const RATE_LIMIT_SAVE_INTERVAL = 10 * time.Second
+
+// limits of a client (0: unlimited)
+type clientLimits struct {
+	transactionsPerMinute int
+	bundlesInFlight       int
+	dailyWork             float64
+}
+
+// saved counters of a client
+type clientCounters struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+	Day     string    `json:"day"`
+	Work    float64   `json:"work"`
+
+	inFlight int
+}
+
+type rateLimiter struct {
+	lock     sync.Mutex
+	defaults clientLimits
+	clients  map[string]*clientCounters
+	store    string
+	dirty    bool
+	stop     chan struct{}
+}
+
+// request over the limit - answered with 429 and Retry-After
+type limitError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+var limiter = &rateLimiter{clients: make(map[string]*clientCounters)}
+
+func configureRateLimits() {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.defaults = clientLimits{
+		transactionsPerMinute: config.AppConfig.GetInt("api.limits.transactionsPerMinute"),
+		bundlesInFlight:       config.AppConfig.GetInt("api.limits.bundlesInFlight"),
+		dailyWork:             config.AppConfig.GetFloat64("api.limits.dailyWork"),
+	}
+	limiter.store = config.AppConfig.GetString("api.limits.store")
+	logs.Log.Debugf("Rate limits: %+v", limiter.defaults)
+
+	if limiter.store == "" {
+		return
+	}
+	if err := limiter.load(); err != nil {
+		logs.Log.Warningf("Rate limit counters could not be loaded from %s: %v", limiter.store, err)
+	}
+	limiter.stop = make(chan struct{})
+	go limiter.saveLoop()
+}
+
+func stopRateLimits() {
+	limiter.lock.Lock()
+	stop := limiter.stop
+	limiter.stop = nil
+	limiter.lock.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	limiter.save()
+}
+
+// limits of the key or the defaults
+func (l *rateLimiter) limits(key *APIKey) clientLimits {
+	limits := l.defaults
+	if key != nil {
+		if key.TransactionsPerMinute > 0 {
+			limits.transactionsPerMinute = key.TransactionsPerMinute
+		}
+		if key.BundlesInFlight > 0 {
+			limits.bundlesInFlight = key.BundlesInFlight
+		}
+		if key.DailyWork > 0 {
+			limits.dailyWork = key.DailyWork
+		}
+	}
+	return limits
+}
+
+// expected number of hashes for a transaction
+func transactionWork(mwm int) float64 {
+	return math.Pow(3, float64(mwm))
+}
+
+func utcDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// check and take the limits for a bundle - release has to be called with the
+// number of completed transactions when the bundle is finished. The tokens and
+// the work of the transactions which weren't done are refunded.
+func (l *rateLimiter) admit(client string, key *APIKey, transactions int, mwm int) (release func(completed int), err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limits := l.limits(key)
+	if limits == (clientLimits{}) {
+		return func(int) {}, nil
+	}
+	now := time.Now()
+	counters, ok := l.clients[client]
+	if !ok {
+		counters = &clientCounters{Tokens: float64(limits.transactionsPerMinute), Updated: now, Day: utcDay(now)}
+		l.clients[client] = counters
+	}
+
+	if limits.bundlesInFlight > 0 && counters.inFlight >= limits.bundlesInFlight {
+		return nil, &limitError{
+			message:    fmt.Sprintf("Too many bundles in flight (max %d)", limits.bundlesInFlight),
+			retryAfter: 1 * time.Second,
+		}
+	}
+
+	// refill the bucket
+	tokens := counters.Tokens
+	if limits.transactionsPerMinute > 0 {
+		capacity := float64(limits.transactionsPerMinute)
+		rate := capacity / 60.0 // per second
+		tokens = math.Min(capacity, tokens+now.Sub(counters.Updated).Seconds()*rate)
+		// a bundle bigger than the bucket needs a full bucket
+		needed := math.Min(float64(transactions), capacity)
+		if tokens < needed {
+			return nil, &limitError{
+				message:    fmt.Sprintf("Too many transactions (max %d per minute)", limits.transactionsPerMinute),
+				retryAfter: time.Duration((needed - tokens) / rate * float64(time.Second)),
+			}
+		}
+	}
+
+	// work of the day
+	work := counters.Work
+	if counters.Day != utcDay(now) {
+		work = 0
+	}
+	bundleWork := float64(transactions) * transactionWork(mwm)
+	if limits.dailyWork > 0 && work+bundleWork > limits.dailyWork {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return nil, &limitError{
+			message:    fmt.Sprintf("Daily work exceeded (max %.0f hashes)", limits.dailyWork),
+			retryAfter: tomorrow.Sub(now),
+		}
+	}
+
+	if limits.transactionsPerMinute > 0 {
+		counters.Tokens = tokens - float64(transactions)
+	}
+	counters.Updated = now
+	counters.Day = utcDay(now)
+	counters.Work = work + bundleWork
+	counters.inFlight++
+	l.dirty = true
+
+	day := counters.Day
+	var once sync.Once
+	return func(completed int) {
+		once.Do(func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			counters.inFlight--
+			unused := transactions - completed
+			if unused <= 0 {
+				return
+			}
+			if limits.transactionsPerMinute > 0 {
+				counters.Tokens = math.Min(float64(limits.transactionsPerMinute), counters.Tokens+float64(unused))
+			}
+			// the work of another day was already reset
+			if counters.Day == day {
+				counters.Work = math.Max(0, counters.Work-float64(unused)*transactionWork(mwm))
+			}
+			l.dirty = true
+		})
+	}, nil
+}
+
+func (l *rateLimiter) load() error {
+	data, err := ioutil.ReadFile(l.store)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var clients map[string]*clientCounters
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return err
+	}
+	// null or broken entries would crash admit
+	for client, counters := range clients {
+		if counters == nil {
+			return fmt.Errorf("no counters for client %q", client)
+		}
+	}
+	if clients != nil {
+		l.clients = clients
+	}
+	return nil
+}
+
+func (l *rateLimiter) saveLoop() {
+	l.lock.Lock()
+	stop := l.stop
+	l.lock.Unlock()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(RATE_LIMIT_SAVE_INTERVAL):
+			l.save()
+		}
+	}
+}
+
+// write the counters if they changed - clients which weren't seen for a day
+// aren't needed anymore
+func (l *rateLimiter) save() {
+	l.lock.Lock()
+	if l.store == "" || !l.dirty {
+		l.lock.Unlock()
+		return
+	}
+	today := utcDay(time.Now())
+	for client, counters := range l.clients {
+		if counters.inFlight == 0 && counters.Day != today && time.Since(counters.Updated) > 24*time.Hour {
+			delete(l.clients, client)
+		}
+	}
+	data, err := json.Marshal(l.clients)
+	l.dirty = false
+	l.lock.Unlock()
+	if err != nil {
+		logs.Log.Error("Rate limit counters:", err)
+		return
+	}
+
+	// replace the file so it's never half written
+	tmp, err := ioutil.TempFile(filepath.Dir(l.store), filepath.Base(l.store))
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), l.store)
+		} else {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		logs.Log.Errorf("Rate limit counters could not be saved to %s: %v", l.store, err)
+	}
+}
+
+// 429 with retry-after for limit errors
+func replyLimitError(err *limitError, c *gin.Context) {
+	seconds := int64(math.Ceil(err.retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      err.message,
+		"retryAfter": seconds * 1000, // ms
+	})
+}
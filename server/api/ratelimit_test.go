@@ -0,0 +1,61 @@
+package api
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestRateLimitRefund(t *testing.T) {
+	l := &rateLimiter{
+		defaults: clientLimits{transactionsPerMinute: 10, dailyWork: 100 * transactionWork(9)},
+		clients:  make(map[string]*clientCounters),
+	}
+	release, err := l.admit("client", nil, 5, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(2)
+	release(0) // only the first release counts
+
+	counters := l.clients["client"]
+	if counters.inFlight != 0 || math.Abs(counters.Tokens-8) > 0.1 || counters.Work != 2*transactionWork(9) {
+		t.Errorf("counters after release: %+v", counters)
+	}
+
+	// a rejected job gets everything back
+	release, err = l.admit("client", nil, 3, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(0)
+	if math.Abs(counters.Tokens-8) > 0.1 || counters.Work != 2*transactionWork(9) {
+		t.Errorf("counters after rejection: %+v", counters)
+	}
+}
+
+func TestRateLimitLoad(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "limits.json")
+	l := &rateLimiter{clients: map[string]*clientCounters{"old": {}}, store: store}
+
+	for _, content := range []string{`null`, `{"a":null}`, `{"a":`} {
+		if err := ioutil.WriteFile(store, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l.load()
+		if len(l.clients) != 1 || l.clients["old"] == nil {
+			t.Fatalf("counters replaced by %s: %v", content, l.clients)
+		}
+	}
+
+	if err := ioutil.WriteFile(store, []byte(`{"new":{"tokens":3}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.clients) != 1 || l.clients["new"] == nil || l.clients["new"].Tokens != 3 {
+		t.Errorf("counters not loaded: %v", l.clients)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// attachToTangle with server-sent events: a "transaction" event for every
+// verified transaction (index, hash, PoW time) and a "trytes" event with the
+// result at the end - or an "error" event
+
+func init() {
+	addAPICall("attachToTangleStream", attachToTangleStream, mainAPICalls)
+}
+
+func attachToTangleStream(request Request, c *gin.Context, t time.Time) {
+	job, err := newAttachJob(c.Request.Context(), request, c)
+	if err != nil {
+		rejectAttach(err, c)
+		return
+	}
+	jobs.add(job)
+	defer jobs.remove(job.id)
+
+	events := job.stream()
+	go job.run()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // nginx
+	c.Status(http.StatusOK)
+	c.SSEvent("job", gin.H{
+		"jobId": job.id,
+		"total": len(request.Trytes),
+	})
+	c.Writer.Flush()
+
+	// closed when the job is finished (also when the client is gone)
+	for event := range events {
+		c.SSEvent("transaction", event)
+		c.Writer.Flush()
+	}
+
+	status := job.status()
+	if status.Status != JobDone.String() {
+		c.SSEvent("error", gin.H{
+			"error": status.Error,
+		})
+	} else {
+		c.SSEvent("trytes", gin.H{
+			"trytes":   job.result(),
+			"duration": getDuration(t),
+		})
+	}
+	c.Writer.Flush()
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"time"
 
 	"github.com/shufps/pidiver/server/logs"
 	flag "github.com/spf13/pflag"
@@ -49,6 +50,21 @@ func Start() {
 	logs.Log.Debugf("Settings loaded: \n %+v", string(cfg))
 }
 
+/*
+Metrics on api.metrics.path (Prometheus text format). The names are stable:
+
+pidiver_pow_duration_seconds{mwm}                  histogram - PoW of a transaction incl. queue wait
+pidiver_pow_queue_wait_seconds                     histogram - wait for an idle device
+pidiver_hashrate_hashes_per_second{device}         gauge - nonce * parallel level / time of the last PoW
+pidiver_hashes_total{device}                       counter
+pidiver_device_errors_total{device,type}           counter - type: crc, protocol, timeout, transmission, device_gone, reservation, not_configured, other
+pidiver_transactions_total{status}                 counter - status: ok, failed, cancelled
+pidiver_bundles_total{status}                      counter - status: ok, failed, cancelled, invalid, limited
+pidiver_device_up{index,type,device}               gauge - 1 in rotation, 0 failed
+pidiver_device_pow_total{index,type,device}        counter
+pidiver_device_crc_errors_total{index,type,device} counter
+pidiver_device_transport_errors_total{index,type,device} counter
+*/
 func declareAPIConfigs() {
 	flag.String("api.auth.username", "", "API Access Username")
 	flag.String("api.auth.password", "", "API Access Password")
@@ -58,23 +74,48 @@ func declareAPIConfigs() {
 	flag.Bool("api.http.useHttp", true, "Defines if the API will serve using HTTP protocol")
 	flag.StringP("api.http.host", "h", "0.0.0.0", "HTTP API Host")
 	flag.IntP("api.http.port", "p", 14265, "HTTP API Port")
-	flag.StringP("api.http.node", "n", "https://iota1.thingslab.network", "IOTA node host")
+	flag.StringP("api.http.node", "n", "https://iota1.thingslab.network", "IOTA node url or host (used if api.proxy.nodes is empty)")
 
 	flag.Bool("api.https.useHttps", false, "Defines if the API will serve using HTTPS protocol")
 	flag.String("api.https.host", "0.0.0.0", "HTTPS API Host")
 	flag.Int("api.https.port", 14266, "HTTPS API Port")
 	flag.String("api.https.certificatePath", "cert.pem", "Path to TLS certificate (non-encrypted)")
 	flag.String("api.https.privateKeyPath", "key.pem", "Path to private key used to isse the TLS certificate (non-encrypted)")
-	flag.String("api.https.node", "https://iota1.thingslab.network", "IOTA node host")
+	flag.String("api.https.node", "https://iota1.thingslab.network", "IOTA node url or host (used if api.proxy.nodes is empty)")
 
 	flag.StringSlice("api.limitRemoteAccess", nil, "Limit access to these commands from remote")
 
 	flag.Int("api.pow.maxMinWeightMagnitude", 14, "Maximum Min-Weight-Magnitude (Difficulty for PoW)")
 	flag.Int("api.pow.maxTransactions", 10000, "Maximum number of Transactions in Bundle (for PoW)")
 
+	flag.String("api.keys.file", "", "File with the API keys (json, toml or yaml) - empty: no keys needed")
+	flag.String("api.keys.header", "X-API-Key", "Header with the API key")
+	flag.Duration("api.keys.reloadInterval", 5*time.Second, "Interval of checking the keys file for changes (0: off)")
+
+	flag.Int("api.limits.transactionsPerMinute", 0, "Transactions per minute of a client - api key or address (0: unlimited)")
+	flag.Int("api.limits.bundlesInFlight", 0, "Bundles of a client in progress at the same time (0: unlimited)")
+	flag.Float64("api.limits.dailyWork", 0, "Work per day of a client in expected hashes - 3^MWM per transaction (0: unlimited)")
+	flag.String("api.limits.store", "ratelimits.json", "File for the counters of the limits (empty: not saved)")
+
+	flag.Int("api.jobs.maxJobs", 100, "Maximum number of unfinished attachToTangleAsync jobs (0: unlimited)")
+	flag.Duration("api.jobs.keepFinished", 1*time.Hour, "Time the result of a finished attach job is kept")
+
+	flag.StringSlice("api.proxy.nodes", nil, "IOTA nodes for all commands except PoW - urls or hosts (port 14265), tried in order")
+	flag.Duration("api.proxy.timeout", 60*time.Second, "Timeout of requests to the nodes")
+	flag.Duration("api.proxy.healthCheckInterval", 30*time.Second, "Interval of the node health checks (0: off)")
+	flag.StringSlice("api.proxy.whitelist", nil, "Only proxy these commands (empty: all)")
+	flag.StringSlice("api.proxy.blacklist", nil, "Never proxy these commands")
+
+	flag.Bool("api.metrics.enabled", true, "Serve Prometheus metrics on api.metrics.path")
+	flag.String("api.metrics.path", "/metrics", "HTTP path of the Prometheus metrics")
+
 	flag.StringP("pidiver.core", "", "../pidiver1.1.rbf", "Core file to upload to FPGA")
 	flag.StringP("pidiver.device", "", "/dev/ttyACM0", "Device file for usb communication")
-	flag.StringP("pidiver.type", "", "usbdiver", "'pidiver', 'usbdiver'")
+	flag.StringP("pidiver.type", "", "usbdiver", "'pidiver', 'spidev', 'usbdiver', 'powchip', 'orange_pi_pc', 'pidiver_wp', 'emulator', 'usbdiver_virtual', 'cpu'")
+	flag.StringP("pidiver.fallback", "", "", "Type to use when pidiver.type can't be initialized (e.g. 'cpu')")
+	flag.StringP("pidiver.board", "", "", "Board profile - 'raspberry', 'raspberry_wiringpi', 'orange_pi_pc' or a .json/.toml file (default: board of the type)")
+	flag.StringSlice("pidiver.devices", nil, "Devices of the pool as type:device (e.g. usbdiver:/dev/ttyACM0,usbdiver:/dev/ttyACM1) - overrides pidiver.type and pidiver.device")
+	flag.Duration("pidiver.recoverInterval", 1*time.Minute, "Interval for re-initializing failed devices of the pool (0: never)")
 
 }
 
@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/op/go-logging"
+	"github.com/shufps/pidiver/pidiver"
 	"github.com/spf13/viper"
 )
 
@@ -25,6 +26,7 @@ func SetConfig(viperConfig *viper.Viper) {
 	if err == nil {
 		consoleBackEndLeveled := logging.AddModuleLevel(consoleBackEnd)
 		consoleBackEndLeveled.SetLevel(level, "server")
+		consoleBackEndLeveled.SetLevel(level, "pidiver")
 
 		logging.SetBackend(consoleBackEndLeveled)
 
@@ -33,3 +35,29 @@ func SetConfig(viperConfig *viper.Viper) {
 		Log.Warning("Using default log level")
 	}
 }
+
+// adapter for the logger of the pidiver package - messages go to the "pidiver" module
+type pidiverLogger struct {
+	log *logging.Logger
+}
+
+func PidiverLogger() pidiver.Logger {
+	log := logging.MustGetLogger("pidiver")
+	// report the caller in the library instead of the adapter
+	log.ExtraCalldepth = 3
+	return &pidiverLogger{log: log}
+}
+
+func (l *pidiverLogger) Log(level pidiver.Level, msg string, fields ...pidiver.Field) {
+	message := pidiver.FormatMessage(msg, fields)
+	switch level {
+	case pidiver.LevelDebug:
+		l.log.Debug(message)
+	case pidiver.LevelInfo:
+		l.log.Info(message)
+	case pidiver.LevelWarning:
+		l.log.Warning(message)
+	default:
+		l.log.Error(message)
+	}
+}
@@ -3,19 +3,16 @@ package main
 import (
 	//	"flag"
 
-	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
-	"github.com/iotaledger/iota.go/pow"
+	_ "github.com/shufps/pidiver/backends"
 	"github.com/shufps/pidiver/pidiver"
-	"github.com/shufps/pidiver/raspberry"
 	"github.com/shufps/pidiver/server/api"
 	"github.com/shufps/pidiver/server/config"
 	"github.com/shufps/pidiver/server/logs"
-	//	"github.com/shufps/pidiver/orange_pi_pc"
-	//	"github.com/shufps/pidiver/raspberry_wiringPi"
 )
 
 const APP_VERSION = "0.1"
@@ -25,42 +22,13 @@ func main() {
 
 	logs.Start()
 	config.Start()
+	pidiver.SetLogger(logs.PidiverLogger())
 
-	pconfig := pidiver.PiDiverConfig{
-		Device:         config.AppConfig.GetString("pidiver.device"),
-		ConfigFile:     config.AppConfig.GetString("pidiver.core"),
-		ForceFlash:     false,
-		ForceConfigure: false,
-		UseCRC:         true,
-		UseSharedLock:  true}
-
-	var powFuncs []pow.ProofOfWorkFunc
-	var err error
-
-	diver := config.AppConfig.GetString("pidiver.type")
-
-	if diver == "usbdiver" {
-		usb := pidiver.USBDiver{Config: &pconfig}
-		err = usb.InitUSBDiver()
-		powFuncs = append(powFuncs, usb.PowUSBDiver)
-	} else if diver == "powchip" {
-		usb := pidiver.USBDiver{Config: &pconfig}
-		powchip := pidiver.PoWChipDiver{USBDiver: &usb}
-		err = powchip.USBDiver.InitUSBDiver()
-		powFuncs = append(powFuncs, powchip.PowPoWChipDiver)
-	} else if diver == "pidiver" {
-		raspi := pidiver.PiDiver{LLStruct: raspberry.GetLowLevel(), Config: &pconfig}
-		err = raspi.InitPiDiver()
-		powFuncs = append(powFuncs, raspi.PowPiDiver)
-	} else {
-		log.Fatalf("unknown type %s\n", diver)
-	}
+	pool := openPool()
+	defer pool.Close()
 
-	if err != nil {
-		logs.Log.Fatal(err)
-	}
-
-	api.SetPowFuncs(powFuncs)
+	api.SetServerVersion(APP_VERSION)
+	api.SetDiverPool(pool)
 	api.Start()
 
 	ch := make(chan os.Signal, 10)
@@ -78,3 +46,59 @@ func main() {
 	}
 
 }
+
+func newConfig(device string) *pidiver.PiDiverConfig {
+	return &pidiver.PiDiverConfig{
+		Device:         device,
+		ConfigFile:     config.AppConfig.GetString("pidiver.core"),
+		Board:          config.AppConfig.GetString("pidiver.board"),
+		ForceFlash:     false,
+		ForceConfigure: false,
+		UseCRC:         true,
+		UseSharedLock:  true,
+		OnEvent:        api.DeviceEventHandler}
+}
+
+// creates a pool of all devices in pidiver.devices (type:device) or of the
+// single device in pidiver.type and pidiver.device
+func openPool() *pidiver.DiverPool {
+	devices := config.AppConfig.GetStringSlice("pidiver.devices")
+	if len(devices) == 0 {
+		devices = []string{config.AppConfig.GetString("pidiver.type") + ":" + config.AppConfig.GetString("pidiver.device")}
+	}
+
+	var divers []pidiver.Diver
+	for _, device := range devices {
+		diverType, path := device, ""
+		if i := strings.Index(device, ":"); i >= 0 {
+			diverType, path = device[:i], device[i+1:]
+		}
+		diver, err := pidiver.NewDiver(diverType, newConfig(path))
+		if err != nil {
+			logs.Log.Fatal(err)
+		}
+		divers = append(divers, diver)
+	}
+
+	pool := pidiver.NewDiverPool(divers...)
+	err := pool.Init()
+	for _, status := range pool.Devices() {
+		if status.State == pidiver.DeviceFailed {
+			logs.Log.Warningf("%s (%s) not available: %v", status.Info.Type, status.Info.Device, status.LastError)
+		}
+	}
+	if fallback := config.AppConfig.GetString("pidiver.fallback"); err != nil && fallback != "" {
+		logs.Log.Warningf("%v - falling back to %s", err, fallback)
+		pool.Close()
+		var diver pidiver.Diver
+		if diver, err = pidiver.OpenDiver(fallback, newConfig(config.AppConfig.GetString("pidiver.device"))); err == nil {
+			pool = pidiver.NewDiverPool(diver)
+		}
+	}
+	if err != nil {
+		logs.Log.Fatal(err)
+	}
+	logs.Log.Infof("Using %d of %d devices", pool.Size(), len(devices))
+	pool.StartRecovery(config.AppConfig.GetDuration("pidiver.recoverInterval"))
+	return pool
+}
@@ -0,0 +1,345 @@
+// Package spidev is a pure-Go LLStruct backend for the PiDiver which talks to the
+// FPGA through the Linux spidev driver (/dev/spidevX.Y). It works on every board
+// with spidev without cgo. The chip select of the FPGA has to be connected to the
+// hardware chip select of the bus (or be configured with cs-gpios in the device tree).
+// The FPGA is configured through the GPIO character device (see package fpga).
+package spidev
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/shufps/pidiver/fpga"
+	"github.com/shufps/pidiver/pidiver"
+)
+
+const (
+	DEFAULT_BOARD = "raspberry"
+
+	DEFAULT_BUS   = 0
+	DEFAULT_CS    = 0
+	DEFAULT_MODE  = 0
+	DEFAULT_SPEED = 7812500 // 250MHz / 32 like the bcm2835 backend
+	DEFAULT_BITS  = 8
+
+	SPI_CPHA = 0x01
+	SPI_CPOL = 0x02
+
+	SPI_MODE_0 = 0
+	SPI_MODE_1 = SPI_CPHA
+	SPI_MODE_2 = SPI_CPOL
+	SPI_MODE_3 = SPI_CPOL | SPI_CPHA
+
+	// linux/spi/spidev.h
+	SPI_IOC_MAGIC = 'k'
+
+	IOC_WRITE     = 1
+	IOC_NRSHIFT   = 0
+	IOC_TYPESHIFT = 8
+	IOC_SIZESHIFT = 16
+	IOC_DIRSHIFT  = 30
+	IOC_SIZEMASK  = 1<<14 - 1
+	TRANSFER_SIZE = 32 // sizeof(struct spi_ioc_transfer)
+	MAX_TRANSFERS = IOC_SIZEMASK / TRANSFER_SIZE
+	WORD_SIZE     = 4 // bytes of a FPGA command
+)
+
+var (
+	SPI_IOC_WR_MODE          = ioc(IOC_WRITE, 1, 1)
+	SPI_IOC_WR_LSB_FIRST     = ioc(IOC_WRITE, 2, 1)
+	SPI_IOC_WR_BITS_PER_WORD = ioc(IOC_WRITE, 3, 1)
+	SPI_IOC_WR_MAX_SPEED_HZ  = ioc(IOC_WRITE, 4, 4)
+)
+
+func ioc(dir uintptr, nr uintptr, size uintptr) uintptr {
+	return dir<<IOC_DIRSHIFT | size<<IOC_SIZESHIFT | SPI_IOC_MAGIC<<IOC_TYPESHIFT | nr<<IOC_NRSHIFT
+}
+
+// SPI_IOC_MESSAGE(n)
+func SPI_IOC_MESSAGE(n int) uintptr {
+	return ioc(IOC_WRITE, 0, uintptr(n*TRANSFER_SIZE))
+}
+
+// struct spi_ioc_transfer
+type Transfer struct {
+	TxBuf       uint64
+	RxBuf       uint64
+	Len         uint32
+	SpeedHz     uint32
+	DelayUsecs  uint16
+	BitsPerWord uint8
+	CSChange    uint8
+	TxNbits     uint8
+	RxNbits     uint8
+	WordDelay   uint8
+	Pad         uint8
+}
+
+// File is the ioctl layer of the driver. It is replaced by a fake in tests.
+type File interface {
+	Ioctl(req uintptr, arg unsafe.Pointer) error
+	Close() error
+}
+
+// opens the device file - can be replaced to inject another ioctl layer
+var Open = openFile
+
+type Config struct {
+	Bus         int
+	ChipSelect  int
+	Mode        uint8
+	SpeedHz     uint32
+	BitsPerWord uint8
+	LSBFirst    bool
+	CSPin       int    // chip select as gpio line (-1: hardware chip select)
+	GPIOChip    string // gpio chip of CSPin
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Bus:         DEFAULT_BUS,
+		ChipSelect:  DEFAULT_CS,
+		Mode:        DEFAULT_MODE,
+		SpeedHz:     DEFAULT_SPEED,
+		BitsPerWord: DEFAULT_BITS,
+		CSPin:       -1,
+		GPIOChip:    fpga.DEFAULT_GPIOCHIP,
+	}
+}
+
+// settings of a board profile
+func BoardConfig(board *pidiver.BoardProfile) Config {
+	config := DefaultConfig()
+	config.Bus = board.SPIBus
+	config.ChipSelect = board.SPIChipSelect
+	config.Mode = uint8(board.SPIMode)
+	config.SpeedHz = uint32(board.SPIClock)
+	config.LSBFirst = board.LSBFirst()
+	config.CSPin = board.CS
+	if board.GPIOChip != "" {
+		config.GPIOChip = board.GPIOChip
+	}
+	return config
+}
+
+func (c Config) Path() string {
+	return fmt.Sprintf("/dev/spidev%d.%d", c.Bus, c.ChipSelect)
+}
+
+// bus and chip select from a device name like /dev/spidev0.1 - other settings are taken from c
+func (c Config) WithDevice(device string) (Config, error) {
+	name := device[strings.LastIndex(device, "/")+1:]
+	if _, err := fmt.Sscanf(name, "spidev%d.%d", &c.Bus, &c.ChipSelect); err != nil {
+		return c, fmt.Errorf("invalid spidev device: %s", device)
+	}
+	return c, nil
+}
+
+func init() {
+	pidiver.RegisterDiver("spidev", func(config *pidiver.PiDiverConfig) (pidiver.Diver, error) {
+		board, err := pidiver.ConfigBoard(config, DEFAULT_BOARD)
+		if err != nil {
+			return nil, err
+		}
+		spiConfig := BoardConfig(board)
+		if strings.Contains(config.Device, "spidev") {
+			if spiConfig, err = spiConfig.WithDevice(config.Device); err != nil {
+				return nil, err
+			}
+		}
+		spi := NewSPI(spiConfig)
+		if board.CanConfigure() || board.ConfDone >= 0 {
+			spi.Configure = func(config *pidiver.PiDiverConfig) error {
+				return fpga.InitGPIOChip(spiConfig.GPIOChip, board, config)
+			}
+		}
+		return &pidiver.PiDiver{LLStruct: spi.LowLevel(), Config: config}, nil
+	})
+}
+
+type SPI struct {
+	Config    Config
+	Configure func(config *pidiver.PiDiverConfig) error // optional - configures the FPGA on init
+
+	lock sync.Mutex
+	file File
+	cs   *fpga.Chip
+}
+
+func NewSPI(config Config) *SPI {
+	return &SPI{Config: config}
+}
+
+func (s *SPI) LowLevel() pidiver.LLStruct {
+	return pidiver.LLStruct{LLInit: s.llInit, LLSPISend: s.send, LLSPISendBlock: s.sendBlock, LLSPISendReceive: s.sendReceive, LLClose: s.llClose}
+}
+
+func (s *SPI) llInit(config *pidiver.PiDiverConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.close()
+
+	if s.Configure != nil {
+		if err := s.Configure(config); err != nil {
+			return err
+		}
+	}
+
+	file, err := Open(s.Config.Path())
+	if err != nil {
+		return fmt.Errorf("%w: %v", pidiver.ErrDeviceGone, err)
+	}
+
+	mode := s.Config.Mode
+	bits := s.Config.BitsPerWord
+	speed := s.Config.SpeedHz
+	var lsb uint8
+	if s.Config.LSBFirst {
+		lsb = 1
+	}
+	for _, setting := range []struct {
+		req uintptr
+		arg unsafe.Pointer
+	}{
+		{SPI_IOC_WR_MODE, unsafe.Pointer(&mode)},
+		{SPI_IOC_WR_LSB_FIRST, unsafe.Pointer(&lsb)},
+		{SPI_IOC_WR_BITS_PER_WORD, unsafe.Pointer(&bits)},
+		{SPI_IOC_WR_MAX_SPEED_HZ, unsafe.Pointer(&speed)},
+	} {
+		if err := file.Ioctl(setting.req, setting.arg); err != nil {
+			file.Close()
+			return fmt.Errorf("couldn't configure %s: %v", s.Config.Path(), err)
+		}
+	}
+	s.file = file
+
+	if s.Config.CSPin >= 0 {
+		if s.cs, err = fpga.OpenChip(s.Config.GPIOChip); err != nil {
+			s.close()
+			return err
+		}
+		if err := s.cs.Output(s.Config.CSPin, true); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SPI) llClose() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.close()
+}
+
+func (s *SPI) close() error {
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	if s.cs != nil {
+		s.cs.Close()
+		s.cs = nil
+	}
+	return err
+}
+
+// message with one transfer - chip select as gpio
+func (s *SPI) transferGPIO(transfer *Transfer) error {
+	if err := s.cs.Set(s.Config.CSPin, false); err != nil {
+		return err
+	}
+	err := s.file.Ioctl(SPI_IOC_MESSAGE(1), unsafe.Pointer(transfer))
+	if err := s.cs.Set(s.Config.CSPin, true); err != nil {
+		return err
+	}
+	return err
+}
+
+// one transfer per buffer in a single message - chip select is released after every buffer.
+// With chip select as gpio every transfer is a message.
+func (s *SPI) transfer(tx [][]byte, rx [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("%w: spidev not initialized", pidiver.ErrDeviceGone)
+	}
+	if len(tx) > MAX_TRANSFERS {
+		return errors.New("too many transfers")
+	}
+
+	transfers := make([]Transfer, len(tx))
+	for i := range tx {
+		transfers[i] = Transfer{
+			TxBuf:       uint64(uintptr(unsafe.Pointer(&tx[i][0]))),
+			Len:         uint32(len(tx[i])),
+			SpeedHz:     s.Config.SpeedHz,
+			BitsPerWord: s.Config.BitsPerWord,
+			CSChange:    1,
+		}
+		if rx != nil && rx[i] != nil {
+			transfers[i].RxBuf = uint64(uintptr(unsafe.Pointer(&rx[i][0])))
+		}
+	}
+	// no cs change after the last transfer - the driver releases cs at the end of the message
+	transfers[len(transfers)-1].CSChange = 0
+
+	var err error
+	if s.cs != nil {
+		for i := 0; i < len(transfers) && err == nil; i++ {
+			transfers[i].CSChange = 0
+			err = s.transferGPIO(&transfers[i])
+		}
+	} else {
+		err = s.file.Ioctl(SPI_IOC_MESSAGE(len(transfers)), unsafe.Pointer(&transfers[0]))
+	}
+	// keep buffers alive until the driver is done with them
+	runtime.KeepAlive(tx)
+	runtime.KeepAlive(rx)
+	return err
+}
+
+// send command
+func (s *SPI) send(data uint32) error {
+	bytedata := make([]byte, WORD_SIZE)
+	binary.BigEndian.PutUint32(bytedata, data)
+	return s.transfer([][]byte{bytedata}, nil)
+}
+
+// send block of data for midstate
+func (s *SPI) sendBlock(data []uint32) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > MAX_TRANSFERS {
+			n = MAX_TRANSFERS
+		}
+		tx := make([][]byte, n)
+		for i := 0; i < n; i++ {
+			tx[i] = make([]byte, WORD_SIZE)
+			binary.BigEndian.PutUint32(tx[i], data[i])
+		}
+		if err := s.transfer(tx, nil); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// send and receive - the answer is clocked out with the next word
+func (s *SPI) sendReceive(cmd uint32) (uint32, error) {
+	bytedata := make([]byte, WORD_SIZE)
+	bytedata_read := make([]byte, WORD_SIZE)
+	binary.BigEndian.PutUint32(bytedata, cmd)
+
+	if err := s.transfer([][]byte{bytedata, make([]byte, WORD_SIZE)}, [][]byte{nil, bytedata_read}); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(bytedata_read), nil
+}
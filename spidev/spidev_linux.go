@@ -0,0 +1,31 @@
+package spidev
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+type file struct {
+	f *os.File
+}
+
+func openFile(path string) (File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &file{f: f}, nil
+}
+
+func (f *file) Ioctl(req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (f *file) Close() error {
+	return f.f.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package spidev
+
+import "errors"
+
+func openFile(path string) (File, error) {
+	return nil, errors.New("spidev is only supported on linux")
+}
@@ -0,0 +1,120 @@
+package spidev
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/iotaledger/iota.go/curl"
+	"github.com/iotaledger/iota.go/trinary"
+	"github.com/shufps/pidiver/pidiver"
+)
+
+// ioctl layer which feeds the words of every transfer into the FPGA emulator.
+// The answer of a word is clocked out with the next transfer like on the real bus.
+type fakeFile struct {
+	ll       pidiver.LLStruct
+	settings map[uintptr]uint32
+	answer   uint32
+	closed   bool
+}
+
+func newFakeFile() *fakeFile {
+	f := &fakeFile{
+		ll:       pidiver.NewEmulator(pidiver.EMULATOR_PARALLEL).LowLevel(),
+		settings: make(map[uintptr]uint32),
+	}
+	f.ll.LLInit(nil)
+	return f
+}
+
+// pointer in a transfer field
+func bufferPointer(field *uint64) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(field))
+}
+
+func (f *fakeFile) Ioctl(req uintptr, arg unsafe.Pointer) error {
+	switch req {
+	case SPI_IOC_WR_MODE, SPI_IOC_WR_LSB_FIRST, SPI_IOC_WR_BITS_PER_WORD:
+		f.settings[req] = uint32(*(*uint8)(arg))
+		return nil
+	case SPI_IOC_WR_MAX_SPEED_HZ:
+		f.settings[req] = *(*uint32)(arg)
+		return nil
+	}
+	if req&^(IOC_SIZEMASK<<IOC_SIZESHIFT) != SPI_IOC_MESSAGE(0) {
+		return errors.New("unknown ioctl")
+	}
+	n := int((req >> IOC_SIZESHIFT) & IOC_SIZEMASK / TRANSFER_SIZE)
+	transfers := (*[MAX_TRANSFERS]Transfer)(arg)[:n:n]
+	for i := range transfers {
+		if transfers[i].Len != WORD_SIZE {
+			return errors.New("invalid transfer length")
+		}
+		tx := (*[WORD_SIZE]byte)(bufferPointer(&transfers[i].TxBuf))
+		if transfers[i].RxBuf != 0 {
+			rx := (*[WORD_SIZE]byte)(bufferPointer(&transfers[i].RxBuf))
+			binary.BigEndian.PutUint32(rx[:], f.answer)
+		}
+		answer, err := f.ll.LLSPISendReceive(binary.BigEndian.Uint32(tx[:]))
+		if err != nil {
+			return err
+		}
+		f.answer = answer
+	}
+	return nil
+}
+
+func (f *fakeFile) Close() error {
+	f.closed = true
+	return f.ll.LLClose()
+}
+
+func TestPoWWithFakeIoctl(t *testing.T) {
+	file := newFakeFile()
+	var opened string
+	Open = func(path string) (File, error) {
+		opened = path
+		return file, nil
+	}
+	defer func() { Open = openFile }()
+
+	config := DefaultConfig()
+	config.Bus = 1
+	config.SpeedHz = 1000000
+	spi := NewSPI(config)
+	diver := &pidiver.PiDiver{LLStruct: spi.LowLevel(), Config: &pidiver.PiDiverConfig{Type: "spidev", Device: config.Path()}}
+	if err := diver.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer diver.Close()
+
+	if opened != "/dev/spidev1.0" {
+		t.Errorf("opened %s", opened)
+	}
+	if file.settings[SPI_IOC_WR_MAX_SPEED_HZ] != 1000000 || file.settings[SPI_IOC_WR_BITS_PER_WORD] != DEFAULT_BITS {
+		t.Errorf("settings: %v", file.settings)
+	}
+	info := diver.Info()
+	if info.Parallel != pidiver.EMULATOR_PARALLEL || info.Version != "1.1" {
+		t.Errorf("info: %+v", info)
+	}
+
+	const mwm = 9
+	trytes := strings.Repeat("9", 2673)
+	nonce, err := diver.PoW(trytes, mwm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := curl.HashTrytes(trytes[:len(trytes)-len(nonce)] + nonce)
+	if zeros := trinary.TrailingZeros(trinary.MustTrytesToTrits(hash)); zeros < mwm {
+		t.Errorf("nonce %s has %d trailing zeros", nonce, zeros)
+	}
+
+	diver.Close()
+	if !file.closed {
+		t.Error("file not closed")
+	}
+}